@@ -2,6 +2,8 @@ package base
 
 
 import (
+    "encoding/json"
+
     "github.com/kirbywarp/rogue/engine"
 )
 
@@ -19,9 +21,27 @@ func NewAI(controller AIController) *AI {
     return &AI{Controller: controller}
 }
 
-func CreateAI() interface{} { return &AI{} }
-func CloneAI(val interface{}) interface{} {
-    tmp := *(val.(*AI))
+/*
+AIs save their controller by its name from RegisterController
+*/
+func (ai *AI) MarshalJSON() ([]byte, error) {
+    controller, err := controllers.encode(ai.Controller)
+    if err != nil { return nil, err }
+    return json.Marshal(struct{ Controller json.RawMessage }{controller})
+}
+func (ai *AI) UnmarshalJSON(data []byte) error {
+    var enc struct{ Controller json.RawMessage }
+    if err := json.Unmarshal(data, &enc); err != nil { return err }
+
+    controller, err := controllers.decode(enc.Controller)
+    if err != nil { return err }
+    ai.Controller, _ = controller.(AIController)
+    return nil
+}
+
+func CreateAI() *AI { return &AI{} }
+func CloneAI(val *AI) *AI {
+    tmp := *val
     tmp.Controller = tmp.Controller.Clone()
     return &tmp
 }
@@ -42,8 +62,40 @@ func NewArt(symbol rune, fgr, fgg, fgb, bgr, bgg, bgb float64) *Art {
     return &Art{Symbol: symbol, Fg: RGB(fgr, fgg, fgb), Bg: RGB(bgr, bgg, bgb)}
 }
 
-func CreateArt() interface{} { return &Art{} }
-func CloneArt(val interface{}) interface{} { tmp := *(val.(*Art)); return &tmp }
+/*
+Arts encode their symbol as a string, so data files can say "b" rather than 98
+*/
+type encodedArt struct {
+    Symbol string
+    Fg, Bg Color
+}
+func (art *Art) MarshalJSON() ([]byte, error) {
+    enc := encodedArt{Fg: art.Fg, Bg: art.Bg}
+    if art.Symbol != 0 { enc.Symbol = string(art.Symbol) }
+    return json.Marshal(enc)
+}
+func (art *Art) UnmarshalJSON(data []byte) error {
+    // Older saves hold the symbol as a number
+    var enc struct {
+        Symbol json.RawMessage
+        Fg, Bg Color
+    }
+    enc.Fg, enc.Bg = art.Fg, art.Bg
+    if err := json.Unmarshal(data, &enc); err != nil { return err }
+    art.Fg, art.Bg = enc.Fg, enc.Bg
+
+    if len(enc.Symbol) == 0 { return nil }
+    if enc.Symbol[0] != '"' { return json.Unmarshal(enc.Symbol, &art.Symbol) }
+
+    var symbol string
+    if err := json.Unmarshal(enc.Symbol, &symbol); err != nil { return err }
+    art.Symbol = 0
+    for _, char := range symbol { art.Symbol = char; break }
+    return nil
+}
+
+func CreateArt() *Art { return &Art{} }
+func CloneArt(val *Art) *Art { tmp := *val; return &tmp }
 
 // ATTACK ============================================================================== //
 
@@ -55,8 +107,8 @@ func NewAttack(damage float64) *Attack {
     return &Attack{Damage: damage}
     }
 
-func CreateAttack() interface{} { return &Attack{} }
-func CloneAttack(val interface{}) interface{} { tmp := *(val.(*Attack)); return &tmp }
+func CreateAttack() *Attack { return &Attack{} }
+func CloneAttack(val *Attack) *Attack { tmp := *val; return &tmp }
 
 // HEALTH ============================================================================== //
 
@@ -91,42 +143,93 @@ func (health *Health) SetCurrent(current float64) {
     }
 }
 
-func CreateHealth() interface{} { return &Health{} }
-func CloneHealth(val interface{}) interface{} { tmp := *(val.(*Health)); return &tmp }
+func CreateHealth() *Health { return &Health{} }
+func CloneHealth(val *Health) *Health { tmp := *val; return &tmp }
 
 // POSITION ============================================================================ //
 type Position struct {
     R engine.Entity
     X, Y, Z int64
+    Layer Layer
 }
-func NewPosition(r engine.Entity, x, y, z int64) *Position {
-    return &Position{R: r, X: x, Y: y, Z: z}
+func NewPosition(r engine.Entity, x, y, z int64, layer Layer) *Position {
+    return &Position{R: r, X: x, Y: y, Z: z, Layer: layer}
 }
 
-func CreatePosition() interface{} { return &Position{} }
-func ClonePosition(val interface{}) interface{} { tmp := *(val.(*Position)); return &tmp }
+func CreatePosition() *Position { return &Position{} }
+func ClonePosition(val *Position) *Position { tmp := *val; return &tmp }
 
 // MOVEMENT ============================================================================ //
+/*
+Movements hold the move an entity will make this turn, and how it gets around.
+Everything walks; Flies and Swims let an entity through tiles that only
+flyers or swimmers can cross too.  Waited counts the turns spent so far on a
+move into a tile that takes more than one.
+*/
 type Movement struct {
     Dx, Dy, Dz int64
+    Flies, Swims bool
+    Waited int64
 }
 func NewMovement(dx, dy, dz int64) *Movement {
     return &Movement{Dx: dx, Dy: dy, Dz: dz}
 }
 
-func CreateMovement() interface{} { return &Movement{} }
-func CloneMovement(val interface{}) interface{} { tmp := *(val.(*Movement)); return &tmp }
+func CreateMovement() *Movement { return &Movement{} }
+func CloneMovement(val *Movement) *Movement { tmp := *val; return &tmp }
+
+// TILE ============================================================================ //
+/*
+Tiles describe how terrain and features affect whatever is on them.  Walk, Fly
+and Swim say which ways of moving can get through the tile, and Cost how many
+turns it takes to move on to it, at least one.  Opaque, Flammable and Liquid
+only describe the tile, for games to act on.
+*/
+type Tile struct {
+    Walk, Fly, Swim bool
+    Opaque bool
+    Cost int64
+    Flammable bool
+    Liquid bool
+}
+func NewTile(walk, fly, swim bool, cost int64) *Tile {
+    return &Tile{Walk: walk, Fly: fly, Swim: swim, Cost: cost}
+}
+
+/*
+Passable returns true if something moving as described by mov can get through the tile
+*/
+func (tile *Tile) Passable(mov *Movement) bool {
+    return tile.Walk || tile.Fly && mov.Flies || tile.Swim && mov.Swims
+}
+
+func CreateTile() *Tile { return &Tile{Walk: true, Fly: true, Cost: 1} }
+func CloneTile(val *Tile) *Tile { tmp := *val; return &tmp }
 
 // ENTITY MAP ============================================================================ //
 /* See map.go for type definition */
 
-func CreateEntityMap() interface{} { return NewEntityMap() }
-func CloneEntityMap(val interface{}) interface{} {
+func CreateEntityMap() *EntityMap { return NewEntityMap() }
+func CloneEntityMap(val *EntityMap) *EntityMap {
     newmap := NewEntityMap()
-    for k, v := range val.(*EntityMap).chunks {
+    for k, v := range val.chunks {
         newmap.chunks[k] = v
     }
-    newmap.generator = val.(*EntityMap).generator
+    for k, cells := range val.stacks {
+        newcells := make(map[int][]engine.Entity)
+        for i, stack := range cells { newcells[i] = append([]engine.Entity(nil), stack...) }
+        newmap.stacks[k] = newcells
+    }
+    // Clones are missing any chunks that can't be read, and say so with Err
+    val.eachPaged(func(k ChunkKey, chunk *PagedChunk) {
+        if chunk.Generated { newmap.chunks[k] = chunk.Cells }
+        if len(chunk.Stacks) > 0 { newmap.stacks[k] = chunk.Stacks }
+    })
+    for k, err := range val.failed {
+        if newmap.failed == nil { newmap.failed = make(map[ChunkKey]error) }
+        newmap.failed[k] = err
+    }
+    if val.generator != nil { newmap.generator = val.generator.Clone() }
     return newmap
 }
 
@@ -135,11 +238,17 @@ func CloneEntityMap(val interface{}) interface{} {
 
 
 func RegisterTypes(db *engine.EntityDB) {
-    db.Register("ai", CreateAI, CloneAI)
-    db.Register("art", CreateArt, CloneArt)
-    db.Register("position", CreatePosition, ClonePosition)
-    db.Register("movement", CreateMovement, CloneMovement)
-    db.Register("map", CreateEntityMap, CloneEntityMap)
-    db.Register("health", CreateHealth, CloneHealth)
-    db.Register("attack", CreateAttack, CloneAttack)
+    engine.RegisterStore(db, "ai", CreateAI, CloneAI)
+    engine.RegisterStore(db, "art", CreateArt, CloneArt)
+    engine.RegisterStore(db, "position", CreatePosition, ClonePosition)
+    engine.RegisterStore(db, "movement", CreateMovement, CloneMovement)
+    engine.RegisterStore(db, "map", CreateEntityMap, CloneEntityMap)
+    engine.RegisterStore(db, "health", CreateHealth, CloneHealth)
+    engine.RegisterStore(db, "attack", CreateAttack, CloneAttack)
+    engine.RegisterStore(db, "tile", CreateTile, CloneTile)
+
+    // Keep maps in sync with the entities placed on them
+    db.OnRemove("position", onPositionRemoved)
+    db.Migrate(migrateLayers)
+    db.Migrate(migrateTiles)
 }
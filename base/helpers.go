@@ -11,41 +11,158 @@ import (
 //////////////////////
 
 /*
-HelperPlace puts an entity on to the map at a particular position
+HelperPlace puts an entity on to the map at a particular position and layer
 */
-func HelperPlace(db *engine.EntityDB, eid engine.Entity, r engine.Entity, x, y, z int64) {
-    if !db.Has(r, "map") { return }
+func HelperPlace(db *engine.EntityDB, eid engine.Entity, r engine.Entity, x, y, z int64, layer Layer) {
+    emap, ok := engine.StoreOf[*EntityMap](db).Lookup(r)
+    if !ok { return }
 
-    db.Get(r, "map").(*EntityMap).Set(x, y, z, eid)
-    pos := db.Create(eid, "position").(*Position)
-    pos.R, pos.X, pos.Y, pos.Z = r, x, y, z
+    if layer == LayerTerrain {
+        emap.Set(x, y, z, eid)
+    } else {
+        emap.Add(x, y, z, layer, eid)
+    }
+    engine.StoreOf[*Position](db).Set(eid, NewPosition(r, x, y, z, layer))
 }
 
 /*
 HelperMove validates an entity's attempt to move and sets the entity's
-movement component appropriately.  Returns true if the entity could move
+movement component appropriately.  Returns true if the entity could move.
+Terrain never moves, since every tile has exactly one.
 */
 func HelperMove(db *engine.EntityDB, eid engine.Entity, dx, dy, dz int64) bool {
     if !db.Has(eid, "movement", "position") { return false }
 
-    pos := db.Get(eid, "position").(*Position)
-    emap := db.Get(pos.R, "map").(*EntityMap)
-    mov := db.Get(eid, "movement").(*Movement)
+    pos := engine.StoreOf[*Position](db).Get(eid)
+    mov := engine.StoreOf[*Movement](db).Get(eid)
+    emap, ok := engine.StoreOf[*EntityMap](db).Lookup(pos.R)
+    if !ok { return false }
 
-    // TODO: fix layer system and make it real.
-    // Check the entities in the layer beneath the move target
-    // to see if the entity is a wall (with art symbol '#')
-    target := emap.Get(pos.X+dx, pos.Y+dy, pos.Z+dz-1)
-    if db.Has(target, "art") && db.Get(target, "art").(*Art).Symbol == '#' {
+    // The target's tiles have to let the entity through, and nothing can
+    //  move into a layer another entity is holding on to
+    x, y, z := pos.X+dx, pos.Y+dy, pos.Z+dz
+    if pos.Layer == LayerTerrain || !passable(db, emap, x, y, z, mov) || occupied(db, emap, x, y, z, pos.Layer, eid) {
+        mov.Waited = 0
         mov.Dx = 0
         mov.Dy = 0
         mov.Dz = 0
         return false
     }
 
-    // Move can be done!
+    // Move can be done!  Trying a different one starts the wait over.
+    if mov.Dx != dx || mov.Dy != dy || mov.Dz != dz { mov.Waited = 0 }
     mov.Dx = dx
     mov.Dy = dy
     mov.Dz = dz
     return true
 }
+
+/*
+onPositionRemoved takes an entity off of its map when it loses its position,
+so maps never hold entities that aren't on them anymore
+*/
+func onPositionRemoved(db *engine.EntityDB, event engine.Event) {
+    pos := event.Old.(*Position)
+    emap, ok := engine.StoreOf[*EntityMap](db).Lookup(pos.R)
+    if !ok { return }
+
+    if pos.Layer == LayerTerrain {
+        if emap.Get(pos.X, pos.Y, pos.Z) == event.Entity { emap.Set(pos.X, pos.Y, pos.Z, 0) }
+    } else {
+        emap.Remove(pos.X, pos.Y, pos.Z, pos.Layer, event.Entity)
+    }
+}
+
+/*
+migrateLayers moves entities in saves from before maps had layers into the
+actor layer, where the map put their stacks when it loaded
+*/
+func migrateLayers(db *engine.EntityDB, version int) error {
+    if version >= 4 { return nil }
+
+    maps := engine.StoreOf[*EntityMap](db)
+    positions := engine.StoreOf[*Position](db)
+    for _, eid := range positions.Entities() {
+        pos := positions.Get(eid)
+        emap, ok := maps.Lookup(pos.R)
+        if !ok || pos.Layer != LayerTerrain { continue }
+
+        for _, other := range emap.Stack(pos.X, pos.Y, pos.Z, LayerActors) {
+            if other != eid { continue }
+            pos.Layer = LayerActors
+            positions.MarkChanged(eid)
+            break
+        }
+    }
+    return nil
+}
+
+/*
+migrateTiles gives terrain in saves from before tiles the tile it would have
+had, going by the old rule that walls ('#') stop everything but flyers, and
+lets the flyers of those saves fly
+*/
+func migrateTiles(db *engine.EntityDB, version int) error {
+    if version >= 5 { return nil }
+
+    arts := engine.StoreOf[*Art](db)
+    tiles := engine.StoreOf[*Tile](db)
+    seen := make(map[engine.Entity]bool)
+    engine.StoreOf[*EntityMap](db).Each(func(_ engine.Entity, emap *EntityMap) {
+        for _, chunk := range emap.chunks {
+            if chunk == nil { continue }
+            for _, eid := range chunk {
+                if seen[eid] || eid == 0 || !db.Alive(eid) || tiles.Has(eid) { continue }
+                seen[eid] = true
+
+                tile := CreateTile()
+                if art, ok := arts.Lookup(eid); ok && art.Symbol == '#' { *tile = Tile{Fly: true, Opaque: true, Cost: 1} }
+                tiles.Set(eid, tile)
+            }
+        }
+    })
+
+    positions := engine.StoreOf[*Position](db)
+    engine.StoreOf[*Movement](db).Each(func(eid engine.Entity, mov *Movement) {
+        if pos, ok := positions.Lookup(eid); ok && pos.Layer == LayerFlying { mov.Flies = true }
+    })
+    return nil
+}
+
+/*
+passable returns true if every tile in the terrain and feature layers at
+x,y,z lets something moving as described by mov through.  Entities without
+a tile don't get in the way.
+*/
+func passable(db *engine.EntityDB, emap *EntityMap, x, y, z int64, mov *Movement) bool {
+    tiles := engine.StoreOf[*Tile](db)
+    if tile, ok := tiles.Lookup(emap.Get(x, y, z)); ok && !tile.Passable(mov) { return false }
+    for _, eid := range emap.Stack(x, y, z, LayerFeatures) {
+        if tile, ok := tiles.Lookup(eid); ok && !tile.Passable(mov) { return false }
+    }
+    return true
+}
+
+/*
+moveCost returns how many turns moving on to x,y,z takes, going by the
+costliest tile in the terrain and feature layers there
+*/
+func moveCost(db *engine.EntityDB, emap *EntityMap, x, y, z int64) int64 {
+    tiles := engine.StoreOf[*Tile](db)
+    cost := int64(1)
+    if tile, ok := tiles.Lookup(emap.Get(x, y, z)); ok && tile.Cost > cost { cost = tile.Cost }
+    for _, eid := range emap.Stack(x, y, z, LayerFeatures) {
+        if tile, ok := tiles.Lookup(eid); ok && tile.Cost > cost { cost = tile.Cost }
+    }
+    return cost
+}
+
+/*
+occupied returns true if a living entity other than eid is holding on to an
+exclusive layer at x,y,z
+*/
+func occupied(db *engine.EntityDB, emap *EntityMap, x, y, z int64, layer Layer, eid engine.Entity) bool {
+    if !layer.Exclusive() { return false }
+    top := emap.Top(x, y, z, layer)
+    return top != eid && db.Alive(top)
+}
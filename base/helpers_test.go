@@ -0,0 +1,129 @@
+package base
+
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/kirbywarp/rogue/engine"
+)
+
+
+/*
+preLayerSave is a save from before maps had layers, with a map (entity 1)
+and an actor on it (entity 2) at 1,1,0
+*/
+const preLayerSave = `{"Version": 3, "NextID": 3, "Generations": [0, 0, 0], "Free": [], "Entities": [1, 2],
+"Components": {
+    "map": {"1": {"Chunks": [], "Stacks": [{"X": 0, "Y": 0, "Z": 0, "Cells": {"68": [2]}}], "Generator": null}},
+    "position": {"2": {"R": 1, "X": 1, "Y": 1, "Z": 0}},
+    "movement": {"2": {}}
+}}`
+
+func TestLoadPreLayerSave(t *testing.T) {
+    db := engine.NewEntityDB()
+    RegisterTypes(db)
+    if err := db.Load(strings.NewReader(preLayerSave)); err != nil { t.Fatal(err) }
+
+    tilemap, actor := engine.Entity(1), engine.Entity(2)
+    pos := engine.StoreOf[*Position](db).Get(actor)
+    emap := engine.StoreOf[*EntityMap](db).Get(tilemap)
+    if pos.Layer != LayerActors || emap.Top(1, 1, 0, LayerActors) != actor { t.Fatalf("actor loaded into layer %d", pos.Layer) }
+
+    if !HelperMove(db, actor, 1, 0, 0) { t.Fatal("actor can't move") }
+    SystemMove(db)
+    if len(emap.Stack(1, 1, 0, LayerActors)) != 0 { t.Fatal("actor left behind on its old tile") }
+
+    found := false
+    emap.Each(2, 1, 0, func(eid engine.Entity, layer Layer) bool {
+        found = eid == actor && layer == LayerActors
+        return !found
+    })
+    if !found { t.Fatal("actor not on its new tile") }
+}
+
+/*
+preTileSave is a save from before terrain had tiles, with a map (entity 1)
+of grass (entity 3) with a wall (entity 4) at 1,0,0, a walker (entity 2) at
+0,0,0 and a flyer (entity 5) at 0,1,0
+*/
+var preTileSave = `{"Version": 4, "NextID": 6, "Generations": [0, 0, 0, 0, 0, 0], "Free": [], "Entities": [1, 2, 3, 4, 5],
+"Components": {
+    "map": {"1": {"Chunks": [{"X": 0, "Y": 0, "Z": 0, "Cells": [` + "3" + strings.Repeat(", 3", 63) + ", 4" + strings.Repeat(", 3", 959) + `]}],
+        "Stacks": [{"X": 0, "Y": 0, "Z": 0, "Cells": {"3072": [2], "4100": [5]}}], "Generator": null}},
+    "position": {"2": {"R": 1, "Layer": 3}, "5": {"R": 1, "Y": 1, "Layer": 4}},
+    "movement": {"2": {}, "5": {}},
+    "art": {"3": {"Symbol": "."}, "4": {"Symbol": "#"}}
+}}`
+
+func TestLoadPreTileSave(t *testing.T) {
+    db := engine.NewEntityDB()
+    RegisterTypes(db)
+    if err := db.Load(strings.NewReader(preTileSave)); err != nil { t.Fatal(err) }
+
+    tiles := engine.StoreOf[*Tile](db)
+    if tile, ok := tiles.Lookup(4); !ok || tile.Walk || !tile.Fly { t.Fatalf("wall loaded with tile %+v", tile) }
+    if tile, ok := tiles.Lookup(3); !ok || !tile.Walk { t.Fatalf("grass loaded with tile %+v", tile) }
+
+    walker, flyer := engine.Entity(2), engine.Entity(5)
+    if HelperMove(db, walker, 1, 0, 0) { t.Fatal("walker walked into the wall") }
+    if !HelperMove(db, walker, 0, 1, 0) { t.Fatal("walker can't walk on grass") }
+    if !HelperMove(db, flyer, 1, -1, 0) { t.Fatal("flyer can't fly over the wall") }
+}
+
+func TestPassable(t *testing.T) {
+    grass, wall, water := NewTile(true, true, false, 1), NewTile(false, true, false, 1), NewTile(false, false, true, 2)
+    walker, flyer, swimmer := &Movement{}, &Movement{Flies: true}, &Movement{Swims: true}
+
+    for _, mov := range []*Movement{walker, flyer, swimmer} {
+        if !grass.Passable(mov) { t.Errorf("%+v can't cross grass", *mov) }
+    }
+    if wall.Passable(walker) || !wall.Passable(flyer) || wall.Passable(swimmer) { t.Error("only flyers should cross walls") }
+    if water.Passable(walker) || water.Passable(flyer) || !water.Passable(swimmer) { t.Error("only swimmers should cross water") }
+}
+
+func TestTerrainDoesntMove(t *testing.T) {
+    db, tilemap, _ := mapDB()
+    emap := engine.StoreOf[*EntityMap](db).Get(tilemap)
+    emap.Get(0, 0, 0)
+
+    wall := db.New("movement")
+    HelperPlace(db, wall, tilemap, 1, 1, 0, LayerTerrain)
+    if HelperMove(db, wall, 1, 0, 0) { t.Fatal("terrain could move") }
+
+    // Even movement set by hand leaves it where it is
+    engine.StoreOf[*Movement](db).Get(wall).Dx = 1
+    SystemMove(db)
+    if pos := engine.StoreOf[*Position](db).Get(wall); pos.X != 1 || emap.Get(1, 1, 0) != wall || emap.Get(2, 1, 0) == wall { t.Fatal("terrain moved") }
+    if len(emap.stacks[ChunkAt(2, 1, 0)]) != 0 { t.Fatal("terrain stacked on the map") }
+}
+
+func TestMoveCost(t *testing.T) {
+    db, tilemap, stone := mapDB()
+    emap := engine.StoreOf[*EntityMap](db).Get(tilemap)
+    *engine.StoreOf[*Tile](db).Get(stone) = Tile{Walk: true, Cost: 1}
+    mud := db.New()
+    engine.StoreOf[*Tile](db).Set(mud, NewTile(true, false, false, 3))
+    emap.Set(1, 0, 0, mud)
+
+    walker := db.New("movement")
+    HelperPlace(db, walker, tilemap, 0, 0, 0, LayerActors)
+    positions := engine.StoreOf[*Position](db)
+    for turn := 1; turn <= 3; turn++ {
+        if !HelperMove(db, walker, 1, 0, 0) { t.Fatal("walker couldn't move into mud") }
+        SystemMove(db)
+        if moved := positions.Get(walker).X == 1; moved != (turn == 3) { t.Fatalf("walker in mud after %d turns: %v", turn, moved) }
+    }
+
+    // Cheap tiles take a turn, and giving up on a move starts it over
+    HelperMove(db, walker, 1, 0, 0)
+    SystemMove(db)
+    if positions.Get(walker).X != 2 { t.Fatal("walker didn't leave the mud in one turn") }
+    HelperMove(db, walker, -1, 0, 0)
+    SystemMove(db)
+    HelperMove(db, walker, 0, 0, 0)
+    SystemMove(db)
+    HelperMove(db, walker, -1, 0, 0)
+    SystemMove(db)
+    if positions.Get(walker).X != 2 { t.Fatal("waiting carried over after stopping") }
+}
@@ -2,45 +2,208 @@ package base
 
 
 import (
+    "encoding/json"
+    "sort"
+
     "github.com/kirbywarp/rogue/engine"
 )
 
 
 /*
 ChunkGenerators are tasked with generating new chunks on-demand when something
-tries to get/set a chunk that doesn't exist.
+tries to get/set a chunk that doesn't exist.  They are passed the chunk's
+coordinates, as in ChunkKey.  Cloned maps get their own clone of the generator,
+and generators that hold entities should implement engine.EntityRemapper so
+maps can be copied between databases.
 */
 type ChunkGenerator interface {
     GenerateChunk(*EntityMap, int64, int64, int64)
+    Clone() ChunkGenerator
 }
 
 
 
 
 
+/*
+Layers split each tile of a map into the terrain and the things on top of it,
+separately from the tile's z level.  Every tile on every level has one of each
+layer, drawn from the terrain up.
+*/
+type Layer int
+const (
+    LayerTerrain Layer = iota       // The floor or wall of a tile, exactly one per tile
+    LayerFeatures                   // Fixtures like doors, stairs and furniture
+    LayerItems                      // Things lying on the floor
+    LayerActors                     // Creatures walking around
+    LayerFlying                     // Flying creatures and effects like gas clouds
+    NumLayers
+)
+
+/*
+Exclusive returns true if only one entity at a time can be in the layer on
+a given tile, so that actors can't walk over each other
+*/
+func (layer Layer) Exclusive() bool {
+    return layer == LayerActors || layer == LayerFlying
+}
+
+
+
 /*
 MapChunks represent a square of tiles in a map that can be
-dynamically loaded in as needed.
+dynamically loaded in as needed.  Each chunk is 16x16 tiles and 4 z levels deep.
 */
 type MapChunk [16*16*4]engine.Entity
 
 func (chunk *MapChunk) Get(x, y, z int64) engine.Entity {
-    return chunk[(x&0xF)<<6 + (y&0xF)<<2 + (z&0x3)]
+    return chunk[cellIndex(x, y, z)]
 }
 func (chunk *MapChunk) Set(x, y, z int64, eid engine.Entity) {
-    chunk[(x&0xF)<<6 + (y&0xF)<<2 + (z&0x3)] = eid
+    chunk[cellIndex(x, y, z)] = eid
+}
+
+/*
+cellIndex returns where a tile is within its chunk
+*/
+func cellIndex(x, y, z int64) int {
+    return int((x&0xF)<<6 + (y&0xF)<<2 + (z&0x3))
+}
+
+/*
+stackIndex returns where a layer of a tile is within its chunk's stacks
+*/
+func stackIndex(x, y, z int64, layer Layer) int {
+    return int(layer)<<10 + cellIndex(x, y, z)
+}
+
+/*
+ChunkKeys are the coordinates of a chunk, counted in chunks rather than
+tiles.  Every int64 tile coordinate, negative ones included, falls in
+exactly one chunk.
+*/
+type ChunkKey struct {
+    X, Y, Z int64
+}
+
+func (key ChunkKey) less(other ChunkKey) bool {
+    if key.X != other.X { return key.X < other.X }
+    if key.Y != other.Y { return key.Y < other.Y }
+    return key.Z < other.Z
+}
+
+/*
+ChunkAt returns the key of the chunk holding the tile at x,y,z.  The shifts
+round towards negative infinity, so tile -1 is in chunk -1 rather than 0.
+*/
+func ChunkAt(x, y, z int64) ChunkKey {
+    return ChunkKey{X: x>>4, Y: y>>4, Z: z>>2}
 }
 
 /*
 EntityMaps hold tile data for a contiguous section of the world, addressable
-via x,y,z coordinates.
+via x,y,z coordinates.  Each tile has one terrain entity, kept in the chunk's
+fixed array, and an ordered stack of entities in each of its other layers.
 */
 type EntityMap struct{
-    chunks map[int64]*MapChunk
+    chunks map[ChunkKey]*MapChunk
+    stacks map[ChunkKey]map[int][]engine.Entity     // chunk -> stack index -> bottom to top
     generator ChunkGenerator
+    pager *pager
+    failed map[ChunkKey]error       // chunks that couldn't be paged in or read
+    journal []func()                // undoes changes made in a transaction
+    journaling bool
 }
 func NewEntityMap() *EntityMap {
-    return &EntityMap{chunks: make(map[int64]*MapChunk)}
+    return &EntityMap{chunks: make(map[ChunkKey]*MapChunk), stacks: make(map[ChunkKey]map[int][]engine.Entity)}
+}
+
+/*
+EntityMaps save every generated chunk along with their generator, which must
+be registered with RegisterGenerator.  Saves from before chunks were keyed by
+their coordinates have a packed Key instead.
+*/
+type encodedChunk struct {
+    X, Y, Z int64
+    Key int64 `json:",omitempty"`
+    Cells *MapChunk
+}
+type encodedStacks struct {
+    X, Y, Z int64
+    Cells map[int][]engine.Entity
+}
+type encodedMap struct {
+    Chunks []encodedChunk
+    Stacks []encodedStacks
+    Generator json.RawMessage
+}
+func (m *EntityMap) MarshalJSON() ([]byte, error) {
+    generator, err := generators.encode(m.generator)
+    if err != nil { return nil, err }
+
+    enc := encodedMap{Chunks: make([]encodedChunk, 0, len(m.chunks)), Stacks: make([]encodedStacks, 0, len(m.stacks)), Generator: generator}
+    for key, chunk := range m.chunks {
+        enc.Chunks = append(enc.Chunks, encodedChunk{X: key.X, Y: key.Y, Z: key.Z, Cells: chunk})
+    }
+    for key, cells := range m.stacks {
+        enc.Stacks = append(enc.Stacks, encodedStacks{X: key.X, Y: key.Y, Z: key.Z, Cells: cells})
+    }
+
+    // Paged out chunks are saved too, so saves don't depend on the region
+    //  file, and a map missing chunks it couldn't read can't be saved at all
+    m.eachPaged(func(key ChunkKey, chunk *PagedChunk) {
+        if chunk.Generated { enc.Chunks = append(enc.Chunks, encodedChunk{X: key.X, Y: key.Y, Z: key.Z, Cells: chunk.Cells}) }
+        if len(chunk.Stacks) > 0 { enc.Stacks = append(enc.Stacks, encodedStacks{X: key.X, Y: key.Y, Z: key.Z, Cells: chunk.Stacks}) }
+    })
+    if err := m.Err(); err != nil { return nil, err }
+
+    sort.Slice(enc.Chunks, func(i, j int) bool {
+        a, b := enc.Chunks[i], enc.Chunks[j]
+        return ChunkKey{a.X, a.Y, a.Z}.less(ChunkKey{b.X, b.Y, b.Z})
+    })
+    sort.Slice(enc.Stacks, func(i, j int) bool {
+        a, b := enc.Stacks[i], enc.Stacks[j]
+        return ChunkKey{a.X, a.Y, a.Z}.less(ChunkKey{b.X, b.Y, b.Z})
+    })
+    return json.Marshal(enc)
+}
+func (m *EntityMap) UnmarshalJSON(data []byte) error {
+    var enc encodedMap
+    if err := json.Unmarshal(data, &enc); err != nil { return err }
+
+    generator, err := generators.decode(enc.Generator)
+    if err != nil { return err }
+    m.generator, _ = generator.(ChunkGenerator)
+    m.pager = nil
+    m.failed = nil
+
+    m.chunks = make(map[ChunkKey]*MapChunk)
+    for _, chunk := range enc.Chunks {
+        key := ChunkKey{X: chunk.X, Y: chunk.Y, Z: chunk.Z}
+        if chunk.Key != 0 { key = unpackChunkKey(chunk.Key) }
+        m.chunks[key] = chunk.Cells
+    }
+
+    m.stacks = make(map[ChunkKey]map[int][]engine.Entity)
+    for _, stacks := range enc.Stacks {
+        // Stacks saved before there were layers only held actors
+        cells := make(map[int][]engine.Entity)
+        for i, stack := range stacks.Cells {
+            if i < 1<<10 { i = int(LayerActors)<<10 + i }
+            cells[i] = stack
+        }
+        m.stacks[ChunkKey{X: stacks.X, Y: stacks.Y, Z: stacks.Z}] = cells
+    }
+    return nil
+}
+
+/*
+unpackChunkKey reads the packed keys of older saves, which held each chunk
+coordinate in 20 bits with negative coordinates wrapped around
+*/
+func unpackChunkKey(key int64) ChunkKey {
+    signed := func(bits int64) int64 { return bits<<44>>44 }
+    return ChunkKey{X: signed(key>>40 & 0xFFFFF), Y: signed(key>>20 & 0xFFFFF), Z: signed(key & 0xFFFFF)}
 }
 
 /*
@@ -51,50 +214,261 @@ func (m *EntityMap) RegisterChunkGenerator(generator ChunkGenerator) {
 }
 
 /*
-Get returns the tile at the given x,y,z coordinates.  Each coordinate is 3 bytes wide.
+Get returns the terrain at the given x,y,z coordinates.
+Since it may generate chunks, Get changes the map and needs a write lock when
+the map is shared through an engine.SyncDB.
 */
 func (m *EntityMap) Get(x, y, z int64) engine.Entity {
-    key := (x&0xFFFFF0)<<36 + (y&0xFFFFF0)<<16 + (z&0x3FFFFC)>>2
-    chunk, ok := m.chunks[key]
-    if chunk != nil {
-        return chunk.Get(x, y, z)
-    } else if !ok && m.generator != nil{
-        m.generator.GenerateChunk(m, (x&0xFFFFF0)>>4, (y&0xFFFFF0)>>4, (z&0x3FFFFC)>>2)
-        return m.Get(x, y, z)
-    }
+    if chunk := m.chunk(ChunkAt(x, y, z)); chunk != nil { return chunk.Get(x, y, z) }
     return 0
 }
 
 /*
-Set sets the value of a tile location on the EntityMap.
+Set sets the terrain at a tile location on the EntityMap.
 */
 func (m *EntityMap) Set(x, y, z int64, eid engine.Entity) {
-    key := (x&0xFFFFF0)<<36 + (y&0xFFFFF0)<<16 + (z&0x3FFFFC)>>2
+    key := ChunkAt(x, y, z)
+    chunk := m.chunk(key)
+    if chunk == nil { return }
+
+    if m.journaling {
+        i, old := cellIndex(x, y, z), chunk.Get(x, y, z)
+        m.journal = append(m.journal, func() {
+            if chunk := m.chunk(key); chunk != nil { chunk[i] = old }
+        })
+    }
+    chunk.Set(x, y, z, eid)
+}
+
+/*
+Add puts an entity on top of the stack of entities in a layer at x,y,z.  The
+terrain layer has no stack and is changed with Set instead.
+*/
+func (m *EntityMap) Add(x, y, z int64, layer Layer, eid engine.Entity) {
+    key, i := ChunkAt(x, y, z), stackIndex(x, y, z, layer)
+    if !m.touch(key) { return }
+    m.logStack(key, i)
+    m.setStack(key, i, append(m.stacks[key][i], eid))
+}
+
+/*
+Remove takes an entity out of the stack in a layer at x,y,z, keeping the rest
+of the stack in order.  Returns false if the entity wasn't there.
+*/
+func (m *EntityMap) Remove(x, y, z int64, layer Layer, eid engine.Entity) bool {
+    key, i := ChunkAt(x, y, z), stackIndex(x, y, z, layer)
+    if !m.touch(key) { return false }
+    cells := m.stacks[key]
+    stack := cells[i]
+    for j, other := range stack {
+        if other != eid { continue }
+
+        m.logStack(key, i)
+        stack = append(stack[:j], stack[j+1:]...)
+        cells[i] = stack
+        if len(stack) == 0 { delete(cells, i) }
+        if len(cells) == 0 { delete(m.stacks, key) }
+        return true
+    }
+    return false
+}
+
+/*
+setStack replaces a stack in a layer of a tile, by its chunk and stack index
+*/
+func (m *EntityMap) setStack(key ChunkKey, i int, stack []engine.Entity) {
+    cells, ok := m.stacks[key]
+    if len(stack) == 0 {
+        delete(cells, i)
+        if ok && len(cells) == 0 { delete(m.stacks, key) }
+        return
+    }
+    if !ok {
+        cells = make(map[int][]engine.Entity)
+        m.stacks[key] = cells
+        m.touch(key)
+    }
+    cells[i] = stack
+}
+
+/*
+Journal records changes to the map's terrain and stacks until the transaction
+that read it ends, so they can be undone without cloning the whole map and
+paging every chunk in.  Chunks generated meanwhile are kept either way.
+*/
+func (m *EntityMap) Journal() (func(), func()) {
+    m.journal, m.journaling = nil, true
+    undo := func() {
+        journal := m.journal
+        m.journal, m.journaling = nil, false
+        for i := len(journal) - 1; i >= 0; i-- { journal[i]() }
+    }
+    stop := func() { m.journal, m.journaling = nil, false }
+    return undo, stop
+}
+
+/*
+logStack records how to put a stack back as it is now, while journaling
+*/
+func (m *EntityMap) logStack(key ChunkKey, i int) {
+    if !m.journaling { return }
+    old := append([]engine.Entity(nil), m.stacks[key][i]...)
+    m.journal = append(m.journal, func() {
+        if m.touch(key) { m.setStack(key, i, old) }
+    })
+}
+
+/*
+Stack returns every entity stacked in a layer at x,y,z, from the bottom up
+*/
+func (m *EntityMap) Stack(x, y, z int64, layer Layer) []engine.Entity {
+    if !m.touch(ChunkAt(x, y, z)) { return nil }
+    return append([]engine.Entity(nil), m.stacks[ChunkAt(x, y, z)][stackIndex(x, y, z, layer)]...)
+}
+
+/*
+Top returns the entity on top of the stack in a layer at x,y,z, or 0 if there
+is none.  The top of the terrain layer is the terrain itself.
+*/
+func (m *EntityMap) Top(x, y, z int64, layer Layer) engine.Entity {
+    if layer == LayerTerrain { return m.Get(x, y, z) }
+
+    if !m.touch(ChunkAt(x, y, z)) { return 0 }
+    stack := m.stacks[ChunkAt(x, y, z)][stackIndex(x, y, z, layer)]
+    if len(stack) == 0 { return 0 }
+    return stack[len(stack)-1]
+}
+
+/*
+Each calls fn for every entity on the tile at x,y,z from the top of the
+highest layer down to the terrain, stopping early if fn returns false.  The
+tile must not be changed while iterating.
+*/
+func (m *EntityMap) Each(x, y, z int64, fn func(engine.Entity, Layer) bool) {
+    if !m.touch(ChunkAt(x, y, z)) { return }
+    cells := m.stacks[ChunkAt(x, y, z)]
+    for layer := NumLayers - 1; layer > LayerTerrain; layer-- {
+        stack := cells[stackIndex(x, y, z, layer)]
+        for j := len(stack) - 1; j >= 0; j-- {
+            if !fn(stack[j], layer) { return }
+        }
+    }
+    if terrain := m.Get(x, y, z); terrain != 0 { fn(terrain, LayerTerrain) }
+}
+
+/*
+chunk returns the chunk with the given key, paging it in or generating it
+first if needed
+*/
+func (m *EntityMap) chunk(key ChunkKey) *MapChunk {
+    if !m.touch(key) { return nil }
     chunk, ok := m.chunks[key]
-    if chunk != nil {
-        chunk.Set(x, y, z, eid)
-    } else if !ok && m.generator != nil{
-        m.generator.GenerateChunk(m, (x&0xFFFFF0)>>4, (y&0xFFFFF0)>>4, (z&0x3FFFFC)>>2)
-        m.Set(x, y, z, eid)
+    if !ok && m.generator != nil {
+        m.generator.GenerateChunk(m, key.X, key.Y, key.Z)
+        chunk = m.chunks[key]
     }
+    return chunk
 }
 
 /*
 ChunkGenerated returns true if a particular chunk has already been generated.  This
 doesn't mean the chunk won't be nil internally, just that it shouldn't be passed
-to the chunk generator again.
+to the chunk generator again.  Coordinates are counted in chunks, as with ChunkKey.
 */
 func (m *EntityMap) ChunkGenerated(x, y, z int64) bool {
-    _, ok := m.chunks[(x&0xFFFFF)<<40 + (y&0xFFFFF)<<20 + z&0xFFFFF]
+    key := ChunkKey{X: x, Y: y, Z: z}
+    if _, ok := m.chunks[key]; ok { return true }
+
+    // Chunks paged out with only their stacks still need generating, and
+    //  chunks that can't be paged in mustn't be generated over
+    if m.pager == nil || !m.pager.paged[key] { return false }
+    if !m.touch(key) { return true }
+    _, ok := m.chunks[key]
     return ok
 }
 
 /*
-CreateChunk creates a new chunk at the passed coordinates, overwriting any existing
-data, and returns a pointer to the new chunk.
+CreateChunk creates a new chunk at the passed chunk coordinates, overwriting any
+existing data, and returns a pointer to the new chunk.
 */
 func (m *EntityMap) CreateChunk(x, y, z int64) *MapChunk {
+    key := ChunkKey{X: x, Y: y, Z: z}
     chunk := &MapChunk{}
-    m.chunks[(x&0xFFFFF)<<40 + (y&0xFFFFF)<<20 + z&0xFFFFF] = chunk
+    m.chunks[key] = chunk
+    m.touch(key)
     return chunk
 }
+
+/*
+RemapEntities replaces every entity on the map and in its generator, so maps
+can be copied between databases.  Chunks are shared between cloned maps, so
+any chunk with an entity to replace is copied first.  Stacked entities remapped
+to 0 are taken off the map.  Paged out chunks are remapped where they are,
+without paging them in.
+*/
+func (m *EntityMap) RemapEntities(remap func(engine.Entity) engine.Entity) {
+    if remapper, ok := m.generator.(engine.EntityRemapper); ok { remapper.RemapEntities(remap) }
+
+    for key, chunk := range m.chunks {
+        if chunk, ok := remapChunk(chunk, remap); ok { m.chunks[key] = chunk }
+    }
+    for key, cells := range m.stacks {
+        if remapStacks(cells, remap) && len(cells) == 0 { delete(m.stacks, key) }
+    }
+
+    // Chunks that can't be read are left as they are and reported by Err,
+    //  while ones that can't be written back stay in memory instead
+    m.eachPaged(func(key ChunkKey, paged *PagedChunk) {
+        chunk, changed := remapChunk(paged.Cells, remap)
+        changed = remapStacks(paged.Stacks, remap) || changed
+        if !changed { return }
+
+        paged.Cells = chunk
+        if err := m.pager.store.SaveChunk(key, paged); err != nil {
+            m.restore(key, paged)
+            m.touch(key)
+        }
+    })
+}
+
+/*
+remapChunk returns a remapped copy of a chunk, or false if nothing in it changed
+*/
+func remapChunk(chunk *MapChunk, remap func(engine.Entity) engine.Entity) (*MapChunk, bool) {
+    if chunk == nil { return nil, false }
+
+    var copied *MapChunk
+    for i, eid := range chunk {
+        other := remap(eid)
+        if other == eid { continue }
+        if copied == nil {
+            copied = &MapChunk{}
+            *copied = *chunk
+        }
+        copied[i] = other
+    }
+    if copied == nil { return chunk, false }
+    return copied, true
+}
+
+/*
+remapStacks remaps a chunk's stacks in place, returning true if any changed
+*/
+func remapStacks(cells map[int][]engine.Entity, remap func(engine.Entity) engine.Entity) bool {
+    changed := false
+    for i, stack := range cells {
+        replaced := false
+        kept := make([]engine.Entity, 0, len(stack))
+        for _, eid := range stack {
+            other := remap(eid)
+            if other != eid { replaced = true }
+            if other != 0 { kept = append(kept, other) }
+        }
+        if !replaced { continue }
+
+        changed = true
+        cells[i] = kept
+        if len(kept) == 0 { delete(cells, i) }
+    }
+    return changed
+}
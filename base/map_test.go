@@ -0,0 +1,243 @@
+package base
+
+
+import (
+    "encoding/json"
+    "errors"
+    "math"
+    "math/rand"
+    "testing"
+
+    "github.com/kirbywarp/rogue/engine"
+)
+
+
+/*
+fillGenerator fills every chunk with one entity, and counts the chunks it makes
+*/
+type fillGenerator struct {
+    Fill engine.Entity
+    Made int
+}
+func (g *fillGenerator) GenerateChunk(m *EntityMap, x, y, z int64) {
+    if m.ChunkGenerated(x, y, z) { panic("chunk generated twice") }
+    g.Made++
+    chunk := m.CreateChunk(x, y, z)
+    for i := range chunk { chunk[i] = g.Fill }
+}
+func (g *fillGenerator) Clone() ChunkGenerator {
+    tmp := *g
+    return &tmp
+}
+func (g *fillGenerator) RemapEntities(remap func(engine.Entity) engine.Entity) {
+    g.Fill = remap(g.Fill)
+}
+
+/*
+memoryStore is a ChunkStore that counts how often it's used
+*/
+type memoryStore struct {
+    chunks map[ChunkKey]PagedChunk
+    saves, loads int
+}
+func (store *memoryStore) SaveChunk(key ChunkKey, chunk *PagedChunk) error {
+    store.saves++
+    store.chunks[key] = *chunk
+    return nil
+}
+func (store *memoryStore) LoadChunk(key ChunkKey) (*PagedChunk, error) {
+    store.loads++
+    chunk, ok := store.chunks[key]
+    if !ok { return nil, ErrNoChunk }
+    return &chunk, nil
+}
+
+/*
+brokenStore is a memoryStore that fails to load chunks while broken
+*/
+type brokenStore struct {
+    memoryStore
+    broken bool
+}
+func (store *brokenStore) LoadChunk(key ChunkKey) (*PagedChunk, error) {
+    if store.broken { return nil, errors.New("disk on fire") }
+    return store.memoryStore.LoadChunk(key)
+}
+
+func mapDB() (*engine.EntityDB, engine.Entity, engine.Entity) {
+    db := engine.NewEntityDB()
+    RegisterTypes(db)
+    stone := db.New("tile", "art")
+    tilemap := db.New("map")
+    engine.StoreOf[*EntityMap](db).Get(tilemap).RegisterChunkGenerator(&fillGenerator{Fill: stone})
+    return db, tilemap, stone
+}
+
+/*
+otherDB creates a database to copy into, with ids already used so that
+copies can't end up with the same ids as the originals
+*/
+func otherDB() *engine.EntityDB {
+    db := engine.NewEntityDB()
+    RegisterTypes(db)
+    for i := 0; i < 5; i++ { db.New() }
+    return db
+}
+
+func TestCopyMapRemapsGenerator(t *testing.T) {
+    src, tilemap, stone := mapDB()
+    srcmap := engine.StoreOf[*EntityMap](src).Get(tilemap)
+    srcmap.Get(0, 0, 0)
+
+    dst := otherDB()
+    copied, err := src.CopyTo(dst, tilemap, engine.CopyReferences)
+    if err != nil { t.Fatal(err) }
+
+    dstmap := engine.StoreOf[*EntityMap](dst).Get(copied)
+    for _, terrain := range []engine.Entity{dstmap.Get(0, 0, 0), dstmap.Get(100, -100, 7)} {
+        if terrain == stone || !dst.Has(terrain, "tile", "art") { t.Fatalf("copied map holds %v, not a copy of the stone", terrain) }
+    }
+    if srcmap.generator.(*fillGenerator).Fill != stone || srcmap.Get(100, -100, 7) != stone { t.Fatal("copying changed the source map's generator") }
+}
+
+func TestCopyMapLeavesPagedChunks(t *testing.T) {
+    src, tilemap, stone := mapDB()
+    srcmap := engine.StoreOf[*EntityMap](src).Get(tilemap)
+    store := &memoryStore{chunks: make(map[ChunkKey]PagedChunk)}
+    srcmap.Page(store, 0)
+    for x := int64(0); x < 64; x += 16 { srcmap.Get(x, 0, 0) }
+    if err := srcmap.Evict(func(ChunkKey) bool { return false }); err != nil { t.Fatal(err) }
+
+    dst := otherDB()
+    saves := store.saves
+    copied, err := src.CopyTo(dst, tilemap, engine.CopyReferences)
+    if err != nil { t.Fatal(err) }
+
+    if srcmap.Resident() != 0 || store.saves != saves { t.Fatalf("copying paged in %d chunks and wrote %d", srcmap.Resident(), store.saves-saves) }
+    dstmap := engine.StoreOf[*EntityMap](dst).Get(copied)
+    for x := int64(0); x < 64; x += 16 {
+        if terrain := dstmap.Get(x, 0, 0); terrain == stone || !dst.Has(terrain, "tile") { t.Fatalf("copied chunk at %d holds %v", x, terrain) }
+    }
+    if made := dstmap.generator.(*fillGenerator).Made; made != 4 { t.Fatalf("copied map regenerated chunks, made %d", made) }
+}
+
+func TestPagingErrors(t *testing.T) {
+    stone := engine.Entity(7)
+    m := NewEntityMap()
+    gen := &fillGenerator{Fill: stone}
+    m.RegisterChunkGenerator(gen)
+    store := &brokenStore{memoryStore: memoryStore{chunks: make(map[ChunkKey]PagedChunk)}}
+    m.Page(store, 0)
+    m.Get(3, 3, 0)
+    m.Add(3, 3, 0, LayerItems, 9)
+    if err := m.Evict(func(ChunkKey) bool { return false }); err != nil { t.Fatal(err) }
+
+    // Reads of chunks that can't be paged in come back empty, without regenerating
+    store.broken = true
+    if m.Get(3, 3, 0) != 0 || m.Top(3, 3, 0, LayerItems) != 0 || m.Stack(3, 3, 0, LayerItems) != nil { t.Fatal("unreadable chunk wasn't empty") }
+    m.Set(3, 3, 0, 5)
+    m.Add(3, 3, 0, LayerItems, 10)
+    if gen.Made != 1 || !m.ChunkGenerated(0, 0, 0) { t.Fatalf("unreadable chunk regenerated, made %d", gen.Made) }
+
+    m.RegisterChunkGenerator(nil)
+    if err := m.Err(); err == nil { t.Fatal("Err didn't report the unreadable chunk") }
+    if err := m.Evict(func(ChunkKey) bool { return false }); err == nil { t.Fatal("Evict didn't report the unreadable chunk") }
+    if _, err := json.Marshal(m); err == nil { t.Fatal("saved a map missing a chunk") }
+    if err := m.Page(&memoryStore{chunks: make(map[ChunkKey]PagedChunk)}, 0); err == nil { t.Fatal("moved a map missing a chunk to a new store") }
+
+    // Once the store recovers, so does the map
+    store.broken = false
+    if m.Get(3, 3, 0) != stone || m.Top(3, 3, 0, LayerItems) != 9 { t.Fatal("chunk lost after the store recovered") }
+    if err := m.Err(); err != nil { t.Fatal(err) }
+    if _, err := json.Marshal(m); err != nil { t.Fatal(err) }
+}
+
+func TestRollbackKeepsPaging(t *testing.T) {
+    db, tilemap, _ := mapDB()
+    emap := engine.StoreOf[*EntityMap](db).Get(tilemap)
+    store := &memoryStore{chunks: make(map[ChunkKey]PagedChunk)}
+    emap.Page(store, 1)
+    for x := int64(0); x < 64; x += 16 { emap.Get(x, 0, 0) }
+
+    mover := db.New("movement")
+    HelperPlace(db, mover, tilemap, 49, 0, 0, LayerActors)
+    engine.StoreOf[*Tile](db).Get(emap.Get(48, 0, 0)).Walk = true
+    if err := emap.Evict(func(ChunkKey) bool { return false }); err != nil { t.Fatal(err) }
+    loads := store.loads
+
+    db.Begin()
+    if !HelperMove(db, mover, -1, 0, 0) { t.Fatal("mover couldn't move") }
+    SystemMove(db)
+    emap.Set(48, 0, 0, mover)
+    db.Rollback()
+
+    if emap.pager == nil || emap.pager.store != store { t.Fatal("rollback turned paging off") }
+    if emap.Resident() > 1 { t.Fatalf("rollback left %d chunks resident, want 1", emap.Resident()) }
+    if store.loads != loads { t.Fatalf("transaction read %d paged out chunks", store.loads-loads) }
+    if pos := engine.StoreOf[*Position](db).Get(mover); pos.X != 49 { t.Fatalf("mover rolled back to %d, want 49", pos.X) }
+    if emap.Top(49, 0, 0, LayerActors) != mover || emap.Top(48, 0, 0, LayerActors) != 0 { t.Fatal("rollback didn't put the mover back on the map") }
+    if emap.Get(48, 0, 0) == mover { t.Fatal("rollback didn't restore the terrain") }
+}
+
+/*
+testCoord picks a tile coordinate anywhere in the int64 range, favouring the
+extremes, zero, and the edges of chunks
+*/
+func testCoord(r *rand.Rand) int64 {
+    switch r.Intn(6) {
+    case 0: return r.Int63n(64) - 32
+    case 1: return math.MaxInt64 - r.Int63n(40)
+    case 2: return math.MinInt64 + r.Int63n(40)
+    case 3: return (r.Int63() - r.Int63())&^0xF + r.Int63n(3) - 1
+    case 4: return [...]int64{math.MinInt64, math.MaxInt64, 0, -1, 15, 16, -16, -17}[r.Intn(8)]
+    }
+    return r.Int63() - r.Int63()
+}
+
+func TestChunkProperties(t *testing.T) {
+    r := rand.New(rand.NewSource(21))
+    m := NewEntityMap()
+    gen := &fillGenerator{}
+    m.RegisterChunkGenerator(gen)
+
+    tiles := make(map[[3]int64]engine.Entity)
+    keys := make(map[ChunkKey]bool)
+    for i := 0; i < 3000; i++ {
+        x, y, z := testCoord(r), testCoord(r), testCoord(r)
+        key := ChunkAt(x, y, z)
+
+        // Every tile falls in the chunk below it, whatever its sign
+        if off := x - key.X<<4; off < 0 || off > 15 { t.Fatalf("x %d put in chunk %d", x, key.X) }
+        if off := y - key.Y<<4; off < 0 || off > 15 { t.Fatalf("y %d put in chunk %d", y, key.Y) }
+        if off := z - key.Z<<2; off < 0 || off > 3 { t.Fatalf("z %d put in chunk %d", z, key.Z) }
+        if m.ChunkGenerated(key.X, key.Y, key.Z) != keys[key] { t.Fatalf("chunk %v generated: %v, want %v", key, !keys[key], keys[key]) }
+
+        eid := engine.Entity(i + 1)
+        if r.Intn(4) == 0 && !keys[key] {
+            // Chunks made directly take tile coordinates anywhere inside them
+            m.CreateChunk(key.X, key.Y, key.Z).Set(x, y, z, eid)
+        } else {
+            m.Set(x, y, z, eid)
+        }
+        keys[key] = true
+        tiles[[3]int64{x, y, z}] = eid
+        if !m.ChunkGenerated(key.X, key.Y, key.Z) { t.Fatalf("chunk %v not generated after setting %d,%d,%d", key, x, y, z) }
+    }
+
+    check := func(m *EntityMap) {
+        for tile, eid := range tiles {
+            if got := m.Get(tile[0], tile[1], tile[2]); got != eid { t.Fatalf("tile %v holds %v, want %v", tile, got, eid) }
+        }
+        for key := range keys {
+            if !m.ChunkGenerated(key.X, key.Y, key.Z) { t.Fatalf("chunk %v lost", key) }
+        }
+    }
+    check(m)
+
+    m.RegisterChunkGenerator(nil)
+    data, err := json.Marshal(m)
+    if err != nil { t.Fatal(err) }
+    loaded := NewEntityMap()
+    if err := json.Unmarshal(data, loaded); err != nil { t.Fatal(err) }
+    check(loaded)
+}
@@ -0,0 +1,343 @@
+package base
+
+
+import (
+    "container/list"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "slices"
+
+    "github.com/kirbywarp/rogue/engine"
+)
+
+
+/*
+PagedChunks hold everything an EntityMap keeps about one chunk while it's
+paged out.  Stacks are keyed the same way as the map's own and should be
+stored as they are.
+*/
+type PagedChunk struct {
+    Generated bool          // False if the chunk only had stacks, and should still be generated
+    Cells *MapChunk
+    Stacks map[int][]engine.Entity
+}
+
+/*
+ChunkStores keep the chunks an EntityMap has paged out until they are needed again
+*/
+type ChunkStore interface {
+    SaveChunk(key ChunkKey, chunk *PagedChunk) error
+    LoadChunk(key ChunkKey) (*PagedChunk, error)
+}
+
+/*
+ErrNoChunk is returned when loading a chunk a ChunkStore doesn't have
+*/
+var ErrNoChunk = errors.New("chunk not in store")
+
+
+
+/*
+RegionFiles are ChunkStores backed by a single file on disk.  Chunks are
+written one after the other, and a chunk paged out again reuses its old
+space when it still fits.  Once more than half the file is space left behind
+by chunks that outgrew it, the file is rewritten with only the chunks in use.
+Where each chunk is kept is only held in memory, so region files are
+truncated when opened and only last as long as the game runs; saved games
+hold every chunk themselves.
+*/
+type RegionFile struct {
+    path string
+    file *os.File
+    size, used int64
+    regions map[ChunkKey]region
+}
+type region struct {
+    offset, length, capacity int64
+}
+
+/*
+OpenRegionFile creates the region file at path, truncating any old one
+*/
+func OpenRegionFile(path string) (*RegionFile, error) {
+    file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil { return nil, err }
+    return &RegionFile{path: path, file: file, regions: make(map[ChunkKey]region)}, nil
+}
+
+/*
+compactWaste is how much space a region file leaves behind before compacting,
+however small the file is
+*/
+const compactWaste = 1 << 16
+
+func (rf *RegionFile) SaveChunk(key ChunkKey, chunk *PagedChunk) error {
+    data, err := json.Marshal(chunk)
+    if err != nil { return err }
+
+    size := int64(len(data))
+    reg, ok := rf.regions[key]
+    if !ok || size > reg.capacity { reg = region{offset: rf.size, capacity: size} }
+    if _, err := rf.file.WriteAt(data, reg.offset); err != nil { return err }
+
+    if old, ok := rf.regions[key]; !ok || old.offset != reg.offset { rf.used += reg.capacity - old.capacity }
+    reg.length = size
+    rf.size = max(rf.size, reg.offset+size)
+    rf.regions[key] = reg
+
+    if waste := rf.size - rf.used; waste > compactWaste && waste > rf.used { return rf.compact() }
+    return nil
+}
+
+/*
+compact rewrites the region file with only the chunks in use, packed
+together.  The chunks are copied to a new file that then replaces the old
+one, so a failed compaction leaves everything as it was.
+*/
+func (rf *RegionFile) compact() error {
+    file, err := os.OpenFile(rf.path+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil { return err }
+    fail := func(err error) error {
+        file.Close()
+        os.Remove(file.Name())
+        return err
+    }
+
+    keys := make([]ChunkKey, 0, len(rf.regions))
+    for key := range rf.regions { keys = append(keys, key) }
+
+    regions := make(map[ChunkKey]region, len(rf.regions))
+    size := int64(0)
+    for _, key := range sortedKeys(keys) {
+        reg := rf.regions[key]
+        data := make([]byte, reg.length)
+        if _, err := rf.file.ReadAt(data, reg.offset); err != nil && err != io.EOF { return fail(err) }
+        if _, err := file.WriteAt(data, size); err != nil { return fail(err) }
+
+        regions[key] = region{offset: size, length: reg.length, capacity: reg.length}
+        size += reg.length
+    }
+    if err := os.Rename(file.Name(), rf.path); err != nil { return fail(err) }
+
+    rf.file.Close()
+    rf.file, rf.regions, rf.size, rf.used = file, regions, size, size
+    return nil
+}
+
+func (rf *RegionFile) LoadChunk(key ChunkKey) (*PagedChunk, error) {
+    reg, ok := rf.regions[key]
+    if !ok { return nil, ErrNoChunk }
+
+    data := make([]byte, reg.length)
+    if _, err := rf.file.ReadAt(data, reg.offset); err != nil && err != io.EOF { return nil, err }
+
+    chunk := &PagedChunk{}
+    if err := json.Unmarshal(data, chunk); err != nil { return nil, err }
+    return chunk, nil
+}
+
+/*
+Name returns the path the region file was opened with
+*/
+func (rf *RegionFile) Name() string {
+    return rf.path
+}
+
+/*
+Close closes the region file, leaving it on disk
+*/
+func (rf *RegionFile) Close() error {
+    return rf.file.Close()
+}
+
+
+
+/*
+pagers track which of a map's chunks are resident, least recently used
+last, and which are paged out to the store
+*/
+type pager struct {
+    store ChunkStore
+    resident int
+    lru *list.List
+    used map[ChunkKey]*list.Element
+    paged map[ChunkKey]bool
+}
+
+/*
+Page lets the map page chunks out to a store, keeping up to resident chunks
+in memory.  Chunks are only paged out by Evict, and are paged back in as soon
+as anything on them is needed, so every method of a paging map changes it
+and needs a write lock when the map is shared through an engine.SyncDB.  Paged
+out chunks are still saved and cloned along with the map, though clones don't
+page until told to.
+
+Chunks that can't be paged back in are left where they are, and the map acts
+as if they were empty until a later try succeeds; Err reports them meanwhile.
+Moving a paging map to a new store fails, changing nothing, if chunks paged
+out to the old one can't be paged back in.
+*/
+func (m *EntityMap) Page(store ChunkStore, resident int) error {
+    m.pageAll()
+    if err := m.Err(); err != nil && len(m.pagedKeys()) > 0 { return err }
+    m.failed = nil
+    m.pager = &pager{store: store, resident: resident, lru: list.New(), used: make(map[ChunkKey]*list.Element), paged: make(map[ChunkKey]bool)}
+
+    keys := make([]ChunkKey, 0, len(m.chunks)+len(m.stacks))
+    for key := range m.chunks { keys = append(keys, key) }
+    for key := range m.stacks {
+        if _, ok := m.chunks[key]; !ok { keys = append(keys, key) }
+    }
+    for _, key := range sortedKeys(keys) { m.touch(key) }
+    return nil
+}
+
+/*
+Err returns why a chunk couldn't be paged in or read, if any chunk still can't be
+*/
+func (m *EntityMap) Err() error {
+    if len(m.failed) == 0 { return nil }
+    keys := make([]ChunkKey, 0, len(m.failed))
+    for key := range m.failed { keys = append(keys, key) }
+    return m.failed[sortedKeys(keys)[0]]
+}
+
+/*
+fail records that a chunk couldn't be paged in or read, or that it can be again
+*/
+func (m *EntityMap) fail(key ChunkKey, err error) {
+    if err == nil {
+        delete(m.failed, key)
+        return
+    }
+    if m.failed == nil { m.failed = make(map[ChunkKey]error) }
+    m.failed[key] = fmt.Errorf("EntityMap: Can't page in chunk %v: %w", key, err)
+}
+
+/*
+Resident returns the number of chunks held in memory
+*/
+func (m *EntityMap) Resident() int {
+    if m.pager == nil { return len(m.chunks) }
+    return m.pager.lru.Len()
+}
+
+/*
+Evict pages out the least recently used chunks until no more than the map's
+resident chunks are left in memory, skipping any chunk keep returns true
+for.  Chunks that can't be written to the store stay resident, and the first
+such error is returned, or else any error from Err.
+*/
+func (m *EntityMap) Evict(keep func(ChunkKey) bool) error {
+    if m.pager == nil { return m.Err() }
+
+    var first error
+    for elem := m.pager.lru.Back(); elem != nil && m.pager.lru.Len() > m.pager.resident; {
+        prev := elem.Prev()
+        key := elem.Value.(ChunkKey)
+        if !keep(key) {
+            if err := m.pageOut(key); err != nil && first == nil { first = err }
+        }
+        elem = prev
+    }
+    if first == nil { first = m.Err() }
+    return first
+}
+
+/*
+touch pages a chunk in if it's paged out, and marks it as the most recently
+used.  Returns false if the chunk is paged out and couldn't be paged in.
+*/
+func (m *EntityMap) touch(key ChunkKey) bool {
+    p := m.pager
+    if p == nil { return true }
+    if p.paged[key] && !m.pageIn(key) { return false }
+
+    _, generated := m.chunks[key]
+    _, stacked := m.stacks[key]
+    if elem, ok := p.used[key]; ok {
+        p.lru.MoveToFront(elem)
+    } else if generated || stacked {
+        p.used[key] = p.lru.PushFront(key)
+    }
+    return true
+}
+
+func (m *EntityMap) pageIn(key ChunkKey) bool {
+    chunk, err := m.pager.store.LoadChunk(key)
+    m.fail(key, err)
+    if err != nil { return false }
+
+    m.restore(key, chunk)
+    return true
+}
+
+/*
+restore puts a chunk read from the store back in memory
+*/
+func (m *EntityMap) restore(key ChunkKey, chunk *PagedChunk) {
+    delete(m.pager.paged, key)
+    if chunk.Generated { m.chunks[key] = chunk.Cells }
+    if len(chunk.Stacks) > 0 { m.stacks[key] = chunk.Stacks }
+}
+
+func (m *EntityMap) pageOut(key ChunkKey) error {
+    p := m.pager
+    cells, generated := m.chunks[key]
+    stacks := m.stacks[key]
+    if generated || len(stacks) > 0 {
+        if err := p.store.SaveChunk(key, &PagedChunk{Generated: generated, Cells: cells, Stacks: stacks}); err != nil { return err }
+        p.paged[key] = true
+    }
+
+    delete(m.chunks, key)
+    delete(m.stacks, key)
+    p.lru.Remove(p.used[key])
+    delete(p.used, key)
+    return nil
+}
+
+/*
+pageAll pages every chunk back in, for when the whole map is needed at once
+*/
+func (m *EntityMap) pageAll() {
+    if m.pager == nil { return }
+    for _, key := range sortedKeys(m.pagedKeys()) { m.touch(key) }
+}
+
+func (m *EntityMap) pagedKeys() []ChunkKey {
+    if m.pager == nil { return nil }
+    keys := make([]ChunkKey, 0, len(m.pager.paged))
+    for key := range m.pager.paged { keys = append(keys, key) }
+    return keys
+}
+
+/*
+eachPaged reads every paged out chunk from the store without paging it in,
+returning the first chunk that couldn't be read after trying the rest
+*/
+func (m *EntityMap) eachPaged(fn func(ChunkKey, *PagedChunk)) error {
+    var first error
+    for _, key := range sortedKeys(m.pagedKeys()) {
+        chunk, err := m.pager.store.LoadChunk(key)
+        m.fail(key, err)
+        if err != nil {
+            if first == nil { first = m.failed[key] }
+            continue
+        }
+        fn(key, chunk)
+    }
+    return first
+}
+
+func sortedKeys(keys []ChunkKey) []ChunkKey {
+    slices.SortFunc(keys, func(a, b ChunkKey) int {
+        if a.less(b) { return -1 }
+        if b.less(a) { return 1 }
+        return 0
+    })
+    return keys
+}
@@ -0,0 +1,39 @@
+package base
+
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/kirbywarp/rogue/engine"
+)
+
+
+func TestRegionFileCompacts(t *testing.T) {
+    rf, err := OpenRegionFile(filepath.Join(t.TempDir(), "test.region"))
+    if err != nil { t.Fatal(err) }
+    defer rf.Close()
+
+    // Chunks whose stacks keep growing never fit their old space
+    keys := []ChunkKey{{0, 0, 0}, {-1, 2, 0}, {5, 5, 1}}
+    stack := []engine.Entity{}
+    for i := 0; i < 500; i++ {
+        stack = append(stack, engine.Entity(i+1))
+        for _, key := range keys {
+            chunk := &PagedChunk{Generated: true, Cells: &MapChunk{engine.Entity(i)}, Stacks: map[int][]engine.Entity{1: stack}}
+            if err := rf.SaveChunk(key, chunk); err != nil { t.Fatal(err) }
+        }
+    }
+
+    info, err := os.Stat(rf.Name())
+    if err != nil { t.Fatal(err) }
+    if info.Size() > 2*rf.used+compactWaste { t.Fatalf("region file grew to %d bytes holding %d", info.Size(), rf.used) }
+    if _, err := os.Stat(rf.Name() + ".compact"); !os.IsNotExist(err) { t.Fatal("compaction left its temporary file behind") }
+
+    for _, key := range keys {
+        chunk, err := rf.LoadChunk(key)
+        if err != nil { t.Fatal(err) }
+        if chunk.Cells[0] != 499 || len(chunk.Stacks[1]) != 500 { t.Fatalf("chunk %v loaded from an old save", key) }
+    }
+}
@@ -0,0 +1,81 @@
+package base
+
+
+import (
+    "encoding/json"
+    "fmt"
+    "reflect"
+)
+
+
+/*
+typeRegistries map names to the implementations of an interface, so that
+interface fields like an AI's controller can be saved and loaded by name.
+*/
+type typeRegistry struct {
+    kind string
+    creators map[string]func() interface{}
+    names map[reflect.Type]string
+}
+func newTypeRegistry(kind string) *typeRegistry {
+    return &typeRegistry{kind: kind, creators: make(map[string]func() interface{}), names: make(map[reflect.Type]string)}
+}
+
+/*
+encodedTypes are the saved form of a registered type, naming the type
+along with the type's own JSON encoding
+*/
+type encodedType struct {
+    Type string
+    Data json.RawMessage
+}
+
+func (reg *typeRegistry) register(name string, create func() interface{}) {
+    reg.creators[name] = create
+    reg.names[reflect.TypeOf(create())] = name
+}
+func (reg *typeRegistry) encode(val interface{}) (json.RawMessage, error) {
+    if val == nil { return json.RawMessage("null"), nil }
+
+    name, ok := reg.names[reflect.TypeOf(val)]
+    if !ok { return nil, fmt.Errorf("%s type %T isn't registered", reg.kind, val) }
+
+    data, err := json.Marshal(val)
+    if err != nil { return nil, err }
+    return json.Marshal(encodedType{Type: name, Data: data})
+}
+func (reg *typeRegistry) decode(data json.RawMessage) (interface{}, error) {
+    var enc *encodedType
+    if err := json.Unmarshal(data, &enc); err != nil { return nil, err }
+    if enc == nil { return nil, nil }
+
+    create, ok := reg.creators[enc.Type]
+    if !ok { return nil, fmt.Errorf("%s type '%s' isn't registered", reg.kind, enc.Type) }
+
+    val := create()
+    if err := json.Unmarshal(enc.Data, val); err != nil { return nil, err }
+    return val, nil
+}
+
+
+
+var (
+    controllers = newTypeRegistry("AI controller")
+    generators = newTypeRegistry("Chunk generator")
+)
+
+/*
+RegisterController makes an AIController type saveable under the passed name.
+The create function must return a pointer to an empty controller.
+*/
+func RegisterController(name string, create func() AIController) {
+    controllers.register(name, func() interface{} { return create() })
+}
+
+/*
+RegisterGenerator makes a ChunkGenerator type saveable under the passed name.
+The create function must return a pointer to an empty generator.
+*/
+func RegisterGenerator(name string, create func() ChunkGenerator) {
+    generators.register(name, func() interface{} { return create() })
+}
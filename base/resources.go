@@ -0,0 +1,111 @@
+package base
+
+
+import (
+    "github.com/kirbywarp/rogue/engine"
+)
+
+
+// TURN ============================================================================ //
+/*
+Turn counts how many turns the game has run for
+*/
+type Turn struct {
+    Count uint64
+}
+
+// CLOCK ============================================================================ //
+/*
+Clock tracks how much game time has passed, in seconds
+*/
+type Clock struct {
+    Time float64
+}
+
+// RNG ============================================================================ //
+/*
+RNGs are small, seedable random number generators whose whole state is saved
+with the world, so a loaded game rolls the same numbers it would have
+*/
+type RNG struct {
+    State uint64
+}
+func NewRNG(seed uint64) *RNG {
+    return &RNG{State: seed}
+}
+
+/*
+Uint64 returns a random 64 bit number, using the splitmix64 algorithm
+*/
+func (rng *RNG) Uint64() uint64 {
+    rng.State += 0x9E3779B97F4A7C15
+    z := rng.State
+    z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+    z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+    return z ^ (z >> 31)
+}
+
+/*
+Int63n returns a random number in [0, n).  Panics if n <= 0.
+*/
+func (rng *RNG) Int63n(n int64) int64 {
+    if n <= 0 { panic("RNG: Int63n needs a positive n") }
+    return int64(rng.Uint64() >> 1) % n
+}
+
+/*
+Float64 returns a random number in [0, 1)
+*/
+func (rng *RNG) Float64() float64 {
+    return float64(rng.Uint64() >> 11) / (1 << 53)
+}
+
+// PLAYERS ============================================================================ //
+/*
+Players lists the entities controlled by players
+*/
+type Players struct {
+    Entities []engine.Entity
+}
+
+func (players *Players) Add(eid engine.Entity) {
+    players.Remove(eid)
+    players.Entities = append(players.Entities, eid)
+}
+func (players *Players) Remove(eid engine.Entity) {
+    for i, other := range players.Entities {
+        if other == eid {
+            players.Entities = append(players.Entities[:i], players.Entities[i+1:]...)
+            return
+        }
+    }
+}
+
+// CONFIG ============================================================================ //
+/*
+Config holds the settings a world was made with, saved along with it
+*/
+type Config struct {
+    PageDistance int64      // How many chunks away from a player chunks are kept in memory
+    ResidentChunks int      // How many chunks a paging map keeps in memory before paging out
+}
+func NewConfig() *Config {
+    return &Config{PageDistance: 4, ResidentChunks: 64}
+}
+
+// ============================================================================ //
+
+
+
+func RegisterResources(db *engine.EntityDB) {
+    engine.RegisterResource(db, "turn", &Turn{})
+    engine.RegisterResource(db, "clock", &Clock{})
+    engine.RegisterResource(db, "rng", NewRNG(0))
+    engine.RegisterResource(db, "players", &Players{})
+    engine.RegisterResource(db, "config", NewConfig())
+
+    // Deleted players aren't players anymore
+    db.OnDelete(func(db *engine.EntityDB, event engine.Event) {
+        engine.Resource[*Players](db).Remove(event.Entity)
+    })
+}
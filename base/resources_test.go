@@ -0,0 +1,26 @@
+package base
+
+
+import (
+    "bytes"
+    "testing"
+
+    "github.com/kirbywarp/rogue/engine"
+)
+
+
+func TestConfigSaved(t *testing.T) {
+    db := engine.NewEntityDB()
+    RegisterTypes(db)
+    RegisterResources(db)
+    engine.Resource[*Config](db).PageDistance = 2
+
+    var buf bytes.Buffer
+    if err := db.Save(&buf); err != nil { t.Fatal(err) }
+    loaded := engine.NewEntityDB()
+    RegisterTypes(loaded)
+    RegisterResources(loaded)
+    if err := loaded.Load(&buf); err != nil { t.Fatal(err) }
+
+    if config := engine.Resource[*Config](loaded); *config != (Config{PageDistance: 2, ResidentChunks: 64}) { t.Fatalf("config loaded as %+v", *config) }
+}
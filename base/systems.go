@@ -11,22 +11,43 @@ import (
 /////////////////////
 
 /*
-SystemMove applies makes every entity with movement try to move in the map
+SystemMove applies makes every entity with movement try to move in the map.
+Moves on to tiles that cost more than one turn only happen once the entity
+has kept trying them for that many turns.
 */
 func SystemMove(db *engine.EntityDB) {
-    for _, eid := range db.Search("movement", "position") {
-        pos := db.Get(eid, "position").(*Position)
-        mov := db.Get(eid, "movement").(*Movement)
-        emap := db.Get(pos.R, "map").(*EntityMap)
-
-        // Prevent entities from moving on top of each other, temporarily
-        if emap.Get(pos.X+mov.Dx, pos.Y+mov.Dy, pos.Z+mov.Dz) != 0 { continue }
-
-        // Move and update the map
-        emap.Set(pos.X, pos.Y, pos.Z, 0)
-        pos.X += mov.Dx; pos.Y += mov.Dy; pos.Z += mov.Dz
-        emap.Set(pos.X, pos.Y, pos.Z, eid)
-    }
+    positions := engine.StoreOf[*Position](db)
+    maps := engine.StoreOf[*EntityMap](db)
+
+    engine.StoreOf[*Movement](db).Each(func(eid engine.Entity, mov *Movement) {
+        pos, ok := positions.Lookup(eid)
+        if !ok { return }
+        emap, ok := maps.Lookup(pos.R)
+        if !ok { return }
+
+        if mov.Dx == 0 && mov.Dy == 0 && mov.Dz == 0 || pos.Layer == LayerTerrain {
+            mov.Waited = 0
+            return
+        }
+
+        // Check again that the way is clear, in case something else moved
+        //  into an exclusive layer or changed the tiles first
+        x, y, z := pos.X+mov.Dx, pos.Y+mov.Dy, pos.Z+mov.Dz
+        if !passable(db, emap, x, y, z, mov) || occupied(db, emap, x, y, z, pos.Layer, eid) {
+            mov.Waited = 0
+            return
+        }
+        mov.Waited++
+        if mov.Waited < moveCost(db, emap, x, y, z) { return }
+        mov.Waited = 0
+
+        // Move and update the map.  Entities can share the other layers of
+        //  a tile, with the latest arrival on top.
+        emap.Remove(pos.X, pos.Y, pos.Z, pos.Layer, eid)
+        pos.X, pos.Y, pos.Z = x, y, z
+        emap.Add(pos.X, pos.Y, pos.Z, pos.Layer, eid)
+        positions.MarkChanged(eid)
+    })
 }
 
 ////////
@@ -37,8 +58,91 @@ func SystemMove(db *engine.EntityDB) {
 SystemAct allows each entity with an AI to attempt to act
 */
 func SystemAct(db *engine.EntityDB) {
-    for _, eid := range db.Search("ai", "position") {
-        ai := db.Get(eid, "ai").(*AI)
+    positions := engine.StoreOf[*Position](db)
+
+    engine.StoreOf[*AI](db).Each(func(eid engine.Entity, ai *AI) {
+        if !positions.Has(eid) { return }
         ai.Controller.Act(db, eid)
+    })
+}
+
+
+
+//////////
+// TIME //
+//////////
+
+/*
+SystemTick advances the turn counter
+*/
+func SystemTick(db *engine.EntityDB) {
+    engine.Resource[*Turn](db).Count++
+}
+
+
+
+////////////
+// PAGING //
+////////////
+
+/*
+SystemPage pages out chunks of every paging map that are far from all the
+players on it, once the map holds more chunks than it keeps resident.  Chunks
+within the configured PageDistance of a player are kept however long ago they
+were used, along with chunks a level above or below.
+*/
+func SystemPage(db *engine.EntityDB) {
+    positions := engine.StoreOf[*Position](db)
+    distance := engine.Resource[*Config](db).PageDistance
+
+    near := make(map[engine.Entity][]ChunkKey)
+    for _, player := range engine.Resource[*Players](db).Entities {
+        if pos, ok := positions.Lookup(player); ok { near[pos.R] = append(near[pos.R], ChunkAt(pos.X, pos.Y, pos.Z)) }
     }
+
+    engine.StoreOf[*EntityMap](db).Each(func(eid engine.Entity, emap *EntityMap) {
+        // Chunks that fail to page out stay resident and are tried again next
+        //  turn, and ones that fail to page in are tried again when next used,
+        //  with saving failing until they can be
+        _ = emap.Evict(func(key ChunkKey) bool {
+            for _, center := range near[eid] {
+                if abs(key.X-center.X) <= distance && abs(key.Y-center.Y) <= distance && abs(key.Z-center.Z) <= 1 { return true }
+            }
+            return false
+        })
+    })
+}
+
+func abs(n int64) int64 {
+    if n < 0 { return -n }
+    return n
+}
+
+
+
+/*
+RegisterSystems adds the base systems to a scheduler
+*/
+func RegisterSystems(sched *engine.Scheduler) {
+    // AI controllers add whatever else they use with Scheduler.Uses
+    sched.Add(engine.System{
+        Name: "act", Phase: engine.PhaseAI,
+        Reads: []string{"ai", "position", "tile"}, Writes: []string{"movement", "map"},
+        Run: SystemAct,
+    })
+    sched.Add(engine.System{
+        Name: "move", Phase: engine.PhaseMovement, After: []string{"act"},
+        Reads: []string{"movement", "tile"}, Writes: []string{"position", "map"},
+        Run: SystemMove,
+    })
+    sched.Add(engine.System{
+        Name: "tick", Phase: engine.PhaseCleanup,
+        Writes: []string{"turn"},
+        Run: SystemTick,
+    })
+    sched.Add(engine.System{
+        Name: "page", Phase: engine.PhaseCleanup,
+        Reads: []string{"position", "players", "config"}, Writes: []string{"map"},
+        Run: SystemPage,
+    })
 }
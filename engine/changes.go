@@ -0,0 +1,116 @@
+package engine
+
+
+import (
+    "cmp"
+    "slices"
+)
+
+
+/*
+Changes list the entities whose component was added, changed or removed since
+the last checkpoint, in ascending order of entity index.  A component that was
+removed and added back counts as changed, and one that was added and removed
+again isn't listed at all.  Changes made through a pointer to a component are
+only seen once it's marked changed with MarkChanged.
+*/
+type Changes struct {
+    Added []Entity
+    Changed []Entity
+    Removed []Entity
+}
+
+/*
+Diffs hold the changes to every tracked component, by component name
+*/
+type Diff map[string]Changes
+
+/*
+Empty returns true if nothing in the diff changed
+*/
+func (diff Diff) Empty() bool {
+    for _, changes := range diff {
+        if len(changes.Added) > 0 || len(changes.Changed) > 0 || len(changes.Removed) > 0 { return false }
+    }
+    return true
+}
+
+/*
+changeSets track the changes to a single store between checkpoints
+*/
+type changeSet struct {
+    added, changed, removed entitySet
+}
+func (set *changeSet) add(eid Entity) {
+    if set.removed.Has(eid) {
+        set.removed.Remove(eid)
+        set.changed.Add(eid)
+        return
+    }
+    set.added.Add(eid)
+}
+func (set *changeSet) change(eid Entity) {
+    if set.added.Has(eid) { return }
+    set.changed.Add(eid)
+}
+func (set *changeSet) remove(eid Entity) {
+    if set.added.Has(eid) {
+        set.added.Remove(eid)
+        return
+    }
+    set.changed.Remove(eid)
+    set.removed.Add(eid)
+}
+func (set *changeSet) changes() Changes {
+    return Changes{Added: sorted(set.added.dense), Changed: sorted(set.changed.dense), Removed: sorted(set.removed.dense)}
+}
+func (set *changeSet) clear() {
+    set.added.Clear()
+    set.changed.Clear()
+    set.removed.Clear()
+}
+
+func sorted(list []Entity) []Entity {
+    list = append([]Entity(nil), list...)
+    slices.SortFunc(list, func(a, b Entity) int { return cmp.Compare(a.Index(), b.Index()) })
+    return list
+}
+
+
+
+/*
+Track starts recording changes to the named components
+*/
+func (db *EntityDB) Track(components ...string) {
+    for _, name := range components {
+        store := db.Manager(name)
+        if _, ok := db.trackers[store]; !ok { db.trackers[store] = &changeSet{} }
+    }
+}
+
+/*
+Untrack stops recording changes to the named components, forgetting any
+changes not yet checkpointed
+*/
+func (db *EntityDB) Untrack(components ...string) {
+    for _, name := range components { delete(db.trackers, db.Manager(name)) }
+}
+
+/*
+Changes returns every change to the tracked components since the last checkpoint
+*/
+func (db *EntityDB) Changes() Diff {
+    diff := make(Diff)
+    for store, set := range db.trackers { diff[store.Name()] = set.changes() }
+    return diff
+}
+
+/*
+Checkpoint returns every change to the tracked components since the last
+checkpoint and starts recording afresh
+*/
+func (db *EntityDB) Checkpoint() Diff {
+    diff := db.Changes()
+    for _, set := range db.trackers { set.clear() }
+    return diff
+}
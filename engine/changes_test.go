@@ -0,0 +1,41 @@
+package engine
+
+
+import (
+    "slices"
+    "testing"
+)
+
+
+func TestChangeCollapsing(t *testing.T) {
+    db := parallelDB(5)
+    eids := db.Search("health")
+    healths := StoreOf[*testHealth](db)
+    db.Track("health")
+
+    // Each entity goes through a different sequence of changes
+    made := db.New("health")
+    healths.MarkChanged(made)                   // added then changed: added
+    gone := db.New("health")
+    db.Remove(gone, "health")                   // added then removed: nothing
+    db.Remove(eids[0], "health")
+    db.Set(eids[0], "health", &testHealth{})    // removed then added: changed
+    healths.MarkChanged(eids[1])
+    db.Delete(eids[1])                          // changed then removed: removed
+    healths.Set(eids[2], &testHealth{Max: 3})   // replaced: changed
+    db.Remove(eids[3], "attack")                // untracked
+
+    changes := db.Checkpoint()["health"]
+    if !slices.Equal(changes.Added, []Entity{made}) { t.Errorf("added %v, want %v", changes.Added, []Entity{made}) }
+    if !slices.Equal(changes.Changed, []Entity{eids[0], eids[2]}) { t.Errorf("changed %v, want %v", changes.Changed, []Entity{eids[0], eids[2]}) }
+    if !slices.Equal(changes.Removed, []Entity{eids[1]}) { t.Errorf("removed %v, want %v", changes.Removed, []Entity{eids[1]}) }
+    if _, ok := db.Changes()["attack"]; ok { t.Error("untracked component listed") }
+
+    // Checkpoints start afresh
+    if !db.Changes().Empty() { t.Fatalf("changes left after a checkpoint: %v", db.Changes()) }
+    healths.MarkChanged(eids[4])
+    if changes := db.Changes()["health"]; !slices.Equal(changes.Changed, []Entity{eids[4]}) { t.Fatalf("changed %v after the checkpoint", changes.Changed) }
+
+    db.Untrack("health")
+    if len(db.Changes()) != 0 { t.Fatal("untracked component still listed") }
+}
@@ -0,0 +1,158 @@
+package engine
+
+
+import (
+    "sync"
+)
+
+
+type opcode int
+const (
+    opCreate opcode = iota
+    opInstance
+    opSpawn
+    opDelete
+    opSet
+    opRemove
+)
+
+type command struct {
+    op opcode
+    eid, template Entity
+    name string
+    fab prefab
+    comp interface{}
+    components []string
+    options []DeleteOption
+}
+
+
+
+/*
+CommandBuffers record structural changes to an EntityDB so they can be made
+later, all at once, instead of while systems are iterating over components.
+
+Entities made by a command buffer get their ids right away so that commands
+can refer to them, but aren't alive until the buffer is flushed.  Commands on
+entities deleted by the time the buffer is flushed are skipped.
+
+Commands can be recorded from multiple goroutines at once, such as systems
+running in parallel.
+*/
+type CommandBuffer struct {
+    db *EntityDB
+    mu sync.Mutex
+    commands []command
+}
+func NewCommandBuffer(db *EntityDB) *CommandBuffer {
+    return &CommandBuffer{db: db}
+}
+
+/*
+Commands returns the database's shared command buffer, which the game loop
+flushes between systems
+*/
+func (db *EntityDB) Commands() *CommandBuffer {
+    return db.commands
+}
+
+/*
+New creates a new entity, adding the specified empty components on flush
+*/
+func (buf *CommandBuffer) New(components ...string) Entity {
+    for _, name := range components { buf.db.Manager(name) }
+
+    eid := buf.db.reserve()
+    buf.record(command{op: opCreate, eid: eid, components: components})
+    return eid
+}
+
+/*
+Instance creates a new entity, copying the template's components on flush
+*/
+func (buf *CommandBuffer) Instance(template Entity) Entity {
+    eid := buf.db.reserve()
+    buf.record(command{op: opInstance, eid: eid, template: template})
+    return eid
+}
+
+/*
+Spawn creates a new entity, adding copies of the prefab's components on flush
+*/
+func (buf *CommandBuffer) Spawn(name string) Entity {
+    fab := buf.db.prefab(name)
+
+    eid := buf.db.reserve()
+    buf.record(command{op: opSpawn, eid: eid, fab: fab})
+    return eid
+}
+
+/*
+Delete removes an entity from the database on flush
+*/
+func (buf *CommandBuffer) Delete(eid Entity, options ...DeleteOption) {
+    buf.record(command{op: opDelete, eid: eid, options: options})
+}
+
+/*
+Set sets a component on to an entity on flush
+*/
+func (buf *CommandBuffer) Set(eid Entity, name string, component interface{}) {
+    buf.db.Manager(name)
+    buf.record(command{op: opSet, eid: eid, name: name, comp: component})
+}
+
+/*
+Remove removes a component from an entity on flush
+*/
+func (buf *CommandBuffer) Remove(eid Entity, name string) {
+    buf.db.Manager(name)
+    buf.record(command{op: opRemove, eid: eid, name: name})
+}
+
+/*
+Len returns the number of commands waiting to be flushed
+*/
+func (buf *CommandBuffer) Len() int {
+    buf.mu.Lock()
+    defer buf.mu.Unlock()
+    return len(buf.commands)
+}
+
+func (buf *CommandBuffer) record(cmd command) {
+    buf.mu.Lock()
+    buf.commands = append(buf.commands, cmd)
+    buf.mu.Unlock()
+}
+
+/*
+Flush applies every recorded command in order and empties the buffer
+*/
+func (buf *CommandBuffer) Flush() {
+    buf.mu.Lock()
+    commands := buf.commands
+    buf.commands = nil
+    buf.mu.Unlock()
+
+    db := buf.db
+    for _, cmd := range commands {
+        // Reserved entities come to life when the command making them is applied
+        if cmd.op == opCreate || cmd.op == opInstance || cmd.op == opSpawn { db.activate(cmd.eid) }
+        if !db.Alive(cmd.eid) { continue }
+
+        switch cmd.op {
+        case opCreate:
+            for _, name := range cmd.components { db.Manager(name).Create(cmd.eid) }
+        case opInstance:
+            for _, manager := range db.order { manager.Clone(cmd.template, cmd.eid) }
+        case opSpawn:
+            cmd.fab.spawn(db, cmd.eid)
+        case opDelete:
+            db.Delete(cmd.eid, cmd.options...)
+        case opSet:
+            db.Manager(cmd.name).Assign(cmd.eid, cmd.comp)
+        case opRemove:
+            db.Manager(cmd.name).Remove(cmd.eid)
+        }
+    }
+}
@@ -3,58 +3,36 @@ package engine
 
 import (
     "fmt"
+    "reflect"
+    "sync"
 )
 
 
 /*
-Entities are unique names for collections of components
+Entities are unique names for collections of components.  The low 32 bits
+of an entity are an index that gets recycled once the entity is deleted, and
+the high 32 bits are a generation that is bumped each time that happens, so
+stale references to a deleted entity never match whatever reuses its index.
+The zero entity is never allocated and can be used to mean "no entity".
 */
 type Entity uint64
 
-
+func makeEntity(index, generation uint32) Entity {
+    return Entity(uint64(generation)<<32 | uint64(index))
+}
 
 /*
-Managers manage a database of components index by entity id
+Index returns the recyclable index part of the entity
 */
-type manager struct {
-    create func() interface{}
-    clone func(interface{}) interface{}
-    comps map[Entity]interface{}
-}
-func (manager manager) Create(eid Entity) interface{} {
-    comp := manager.create()
-    manager.comps[eid] = comp
-    return comp
+func (eid Entity) Index() uint32 {
+    return uint32(eid)
 }
-func (manager manager) Clone(src, dst Entity) interface{} {
-    oldc, ok := manager.comps[src]
-    if !ok { return nil }
 
-    newc := manager.clone(oldc)
-    manager.comps[dst] = newc
-    return newc
-}
-func (manager manager) Get(eid Entity) interface{} {
-    return manager.comps[eid]
-}
-func (manager manager) Set(eid Entity, comp interface{}) {
-    manager.comps[eid] = comp
-}
-func (manager manager) Remove(eid Entity) {
-    delete(manager.comps, eid)
-}
-func (manager manager) Has(eid Entity) bool {
-    _, ok := manager.comps[eid]
-    return ok
-}
-func (manager manager) Entities() []Entity {
-    list := make([]Entity, len(manager.comps))
-    i := 0
-    for key, _ := range manager.comps {
-        list[i] = key
-        i++
-    }
-    return list
+/*
+Generation returns how many times the entity's index has been recycled
+*/
+func (eid Entity) Generation() uint32 {
+    return uint32(eid >> 32)
 }
 
 
@@ -64,28 +42,92 @@ EntityDBs hold entity data and provide convenience methods for accessing
 components or component managers.
 */
 type EntityDB struct {
-    nextid Entity
+    nextid uint32       // next never before used entity index
+    generations []uint32
+    free []uint32
+    alive entitySet
+    allocMu sync.Mutex
+
     managers map[string]manager
+    order []manager     // every manager in the order registered
+    stores map[reflect.Type]manager
+    queries map[manager][]*Query
+    indexes map[manager][]indexer
+    trackers map[manager]*changeSet
+    handlers map[eventKey][]subscriber
+    nextsub Subscription
+    commands *CommandBuffer
+    prefabs map[string]prefab
+    relations map[string]*relation
+    resources map[reflect.Type]*resource
+    migrations []Migration
+    tx *transaction
 }
 func NewEntityDB() *EntityDB {
-    return &EntityDB{nextid: 1, managers: make(map[string]manager)}
+    db := &EntityDB{
+        nextid: 1,
+        generations: make([]uint32, 1),
+        managers: make(map[string]manager),
+        stores: make(map[reflect.Type]manager),
+        queries: make(map[manager][]*Query),
+        indexes: make(map[manager][]indexer),
+        trackers: make(map[manager]*changeSet),
+        handlers: make(map[eventKey][]subscriber),
+        prefabs: make(map[string]prefab),
+        relations: make(map[string]*relation),
+        resources: make(map[reflect.Type]*resource),
+    }
+    db.commands = NewCommandBuffer(db)
+    return db
 }
 
 /*
 Register registers a new component with the database under the passed name
 */
 func (db *EntityDB) Register(name string, create func() interface{}, clone func(interface{}) interface{}) {
-    db.managers[name] = manager{create: create, clone: clone, comps: make(map[Entity]interface{})}
+    db.register(name, newStore(db, name, create, clone))
+}
+
+/*
+RegisterStore registers a new typed component with the database under the passed
+name and returns its store.  Only one store may be registered per type.
+*/
+func RegisterStore[T any](db *EntityDB, name string, create func() T, clone func(T) T) *Store[T] {
+    kind := reflect.TypeFor[T]()
+    if _, ok := db.stores[kind]; ok { panic(fmt.Sprintf("EntityDB: A store is already registered for type %v", kind)) }
+
+    store := newStore(db, name, create, clone)
+    db.register(name, store)
+    db.stores[kind] = store
+    return store
+}
+
+func (db *EntityDB) register(name string, store manager) {
+    if old, ok := db.managers[name]; ok {
+        for i, other := range db.order {
+            if other == old { db.order = append(db.order[:i:i], db.order[i+1:]...) }
+        }
+    }
+    db.managers[name] = store
+    db.order = append(db.order, store)
+}
+
+/*
+StoreOf retrieves the typed store registered for a component type
+*/
+func StoreOf[T any](db *EntityDB) *Store[T] {
+    store, err := TryStoreOf[T](db)
+    if err != nil { panic(err) }
+    return store
 }
 
 /*
 New creates a new entity, optionally with the specified empty components
 */
 func (db *EntityDB) New(components ...string) Entity {
-    eid := db.nextid
-    db.nextid++
+    eid := db.allocate()
 
-    for _, name := range components { db.managers[name].Create(eid) }
+    for _, name := range components { db.Manager(name).Create(eid) }
     return eid
 }
 
@@ -93,26 +135,100 @@ func (db *EntityDB) New(components ...string) Entity {
 Instance creates a new entity using the passed entity as a template.
 */
 func (db *EntityDB) Instance(template Entity) Entity {
-    eid := db.nextid
-    db.nextid++
+    eid := db.allocate()
 
-    for _, manager := range db.managers { manager.Clone(template, eid) }
+    for _, manager := range db.order { manager.Clone(template, eid) }
     return eid
 }
 
 /*
-Delete removes an entity from the database
+Delete removes an entity from the database, along with every relation to or
+from it.  Options can make the deletion cascade to related entities.  Deleting
+an entity that isn't alive does nothing.
+*/
+func (db *EntityDB) Delete(eid Entity, options ...DeleteOption) {
+    if !db.Alive(eid) { return }
+
+    if db.listening(EventDelete, "") { db.emit(Event{Kind: EventDelete, Entity: eid}) }
+    for _, manager := range db.order { manager.Remove(eid) }
+
+    // Work out what to cascade to before the relations are dropped
+    var cascade []Entity
+    for _, option := range options {
+        cascade = append(cascade, db.relations[option.relation].sourcesOf(eid)...)
+    }
+    for _, rel := range db.relations { rel.drop(eid) }
+
+    db.alive.Remove(eid)
+    db.generations[eid.Index()]++
+    db.free = append(db.free, eid.Index())
+    db.record(func() {
+        db.free = db.free[:len(db.free)-1]
+        db.generations[eid.Index()]--
+        db.alive.Add(eid)
+    })
+
+    for _, other := range cascade { db.Delete(other, options...) }
+}
+
+/*
+Alive returns true if the entity has been created and not yet deleted
 */
-func (db *EntityDB) Delete(eid Entity) {
-    for _, manager := range db.managers { manager.Remove(eid) }
+func (db *EntityDB) Alive(eid Entity) bool {
+    return db.alive.Has(eid)
 }
 
 /*
-Manager retrieves the appropriate manager for a component type
+allocate hands out a new, living entity
+*/
+func (db *EntityDB) allocate() Entity {
+    eid := db.reserve()
+    db.activate(eid)
+    return eid
+}
+
+/*
+activate brings a reserved entity to life
+*/
+func (db *EntityDB) activate(eid Entity) {
+    db.alive.Add(eid)
+    db.record(func() { db.alive.Remove(eid) })
+}
+
+/*
+reserve picks an id for a new entity without bringing it to life, reusing the
+index of a deleted entity if one is available.  Reserving is safe to do from
+multiple goroutines at once, so long as nothing is creating or deleting
+entities directly.
+*/
+func (db *EntityDB) reserve() Entity {
+    db.allocMu.Lock()
+    defer db.allocMu.Unlock()
+
+    var index uint32
+    if l := len(db.free); l > 0 {
+        index = db.free[l-1]
+        db.free = db.free[:l-1]
+        db.record(func() { db.free = append(db.free, index) })
+    } else {
+        index = db.nextid
+        db.nextid++
+        db.generations = append(db.generations, 0)
+        db.record(func() {
+            db.nextid--
+            db.generations = db.generations[:db.nextid]
+        })
+    }
+    return makeEntity(index, db.generations[index])
+}
+
+/*
+Manager retrieves the appropriate manager for a component type.  Panics if
+no component is registered under that name; see TryManager.
 */
 func (db *EntityDB) Manager(name string) manager {
-    manager, ok := db.managers[name]
-    if !ok { panic(fmt.Sprintf("EntityDB: No manager registered for component '%s'", name)) }
+    manager, err := db.TryManager(name)
+    if err != nil { panic(err) }
     return manager
 }
 
@@ -124,10 +240,10 @@ func (db *EntityDB) Create(eid Entity, name string) interface{} {
 }
 
 /*
-Get retrieves a component for the given entity
+Get retrieves a component for the given entity, or nil if it has none
 */
 func (db *EntityDB) Get(eid Entity, name string) interface{} {
-    return db.Manager(name).Get(eid)
+    return db.Manager(name).Value(eid)
 }
 
 /*
@@ -135,7 +251,7 @@ Set directly sets a component on to an entity, overwriting
 any previous component.
 */
 func (db *EntityDB) Set(eid Entity, name string, component interface{}) {
-    db.Manager(name).Set(eid, component)
+    db.Manager(name).Assign(eid, component)
 }
 
 /*
@@ -145,6 +261,13 @@ func (db *EntityDB) Remove(eid Entity, name string) {
     db.Manager(name).Remove(eid)
 }
 
+/*
+MarkChanged tells the database a component was changed through its pointer
+*/
+func (db *EntityDB) MarkChanged(eid Entity, name string) {
+    db.Manager(name).MarkChanged(eid)
+}
+
 /*
 Has returns true if the passed entity has every given component
 */
@@ -156,15 +279,54 @@ func (db *EntityDB) Has(eid Entity, components ...string) bool {
 }
 
 /*
-Search returns a list of Entities that have the given list of components
+Search returns a list of Entities that have the given list of components, in
+ascending order of entity index
 */
 func (db *EntityDB) Search(name string, components ...string) []Entity {
-    base := db.Manager(name).Entities()
-    retval := make([]Entity, 0, len(base))
-    for _, eid := range base {
-        if db.Has(eid, components...) {
-            retval = append(retval, eid)
-        }
+    return db.Query(name, components...).Entities()
+}
+
+/*
+settle puts every store and cached query back into ascending order, so that
+iterating them afterwards only reads.  It must be called before anything
+iterates the database from multiple goroutines at once.
+*/
+func (db *EntityDB) settle() {
+    db.alive.Sort()
+    for _, manager := range db.order { manager.sort() }
+    for _, queries := range db.queries {
+        for _, query := range queries { query.matches.Sort() }
+    }
+    for _, indexes := range db.indexes {
+        for _, index := range indexes { index.sort() }
+    }
+}
+
+/*
+added, removed and changed are called by stores whenever an entity gains, loses
+or replaces a component, keeping cached queries, indexes and tracked changes up
+to date and sending events
+*/
+func (db *EntityDB) added(store manager, eid Entity, comp interface{}) {
+    for _, query := range db.queries[store] { query.update(eid) }
+    for _, index := range db.indexes[store] { index.update(eid) }
+    if set, ok := db.trackers[store]; ok { set.add(eid) }
+    if db.listening(EventAdd, store.Name()) {
+        db.emit(Event{Kind: EventAdd, Entity: eid, Component: store.Name(), New: comp})
+    }
+}
+func (db *EntityDB) removed(store manager, eid Entity, comp interface{}) {
+    for _, query := range db.queries[store] { query.update(eid) }
+    for _, index := range db.indexes[store] { index.update(eid) }
+    if set, ok := db.trackers[store]; ok { set.remove(eid) }
+    if db.listening(EventRemove, store.Name()) {
+        db.emit(Event{Kind: EventRemove, Entity: eid, Component: store.Name(), Old: comp})
+    }
+}
+func (db *EntityDB) changed(store manager, eid Entity, old, comp interface{}) {
+    for _, index := range db.indexes[store] { index.update(eid) }
+    if set, ok := db.trackers[store]; ok { set.change(eid) }
+    if db.listening(EventChange, store.Name()) {
+        db.emit(Event{Kind: EventChange, Entity: eid, Component: store.Name(), Old: old, New: comp})
     }
-    return retval
 }
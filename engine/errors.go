@@ -0,0 +1,167 @@
+package engine
+
+
+import (
+    "errors"
+    "fmt"
+    "reflect"
+)
+
+
+/*
+The kinds of error returned by the Try variants of EntityDB methods and by
+schemas.  Check for them with errors.Is.
+*/
+var (
+    ErrUnknownComponent = errors.New("unknown component")
+    ErrNoComponent = errors.New("no such component")
+    ErrDeadEntity = errors.New("entity is not alive")
+    ErrWrongType = errors.New("wrong component type")
+    ErrUnknownPrefab = errors.New("unknown prefab")
+    ErrUnknownResource = errors.New("unknown resource")
+    ErrNoField = errors.New("no such field")
+)
+
+/*
+Errors say what went wrong with which entity and component, prefab, resource
+or type.  The methods that panic instead of returning errors panic with these.
+*/
+type Error struct {
+    Err error
+    Entity Entity
+    Name string
+}
+func (err *Error) Error() string {
+    subject := ""
+    switch {
+    case err.Name != "" && err.Entity != 0: subject = fmt.Sprintf("'%s' of entity %d: ", err.Name, err.Entity)
+    case err.Name != "": subject = fmt.Sprintf("'%s': ", err.Name)
+    case err.Entity != 0: subject = fmt.Sprintf("entity %d: ", err.Entity)
+    }
+    return "EntityDB: " + subject + err.Err.Error()
+}
+func (err *Error) Unwrap() error {
+    return err.Err
+}
+
+
+
+/*
+TryManager retrieves the appropriate manager for a component type
+*/
+func (db *EntityDB) TryManager(name string) (manager, error) {
+    manager, ok := db.managers[name]
+    if !ok { return nil, &Error{Err: ErrUnknownComponent, Name: name} }
+    return manager, nil
+}
+
+/*
+TryNew creates a new entity with the specified empty components
+*/
+func (db *EntityDB) TryNew(components ...string) (Entity, error) {
+    for _, name := range components {
+        if _, err := db.TryManager(name); err != nil { return 0, err }
+    }
+    return db.New(components...), nil
+}
+
+/*
+TrySpawn creates a new entity from the named prefab
+*/
+func (db *EntityDB) TrySpawn(name string) (Entity, error) {
+    if !db.HasPrefab(name) { return 0, &Error{Err: ErrUnknownPrefab, Name: name} }
+    return db.Spawn(name), nil
+}
+
+/*
+TryCreate creates a new component for the given entity and returns it
+*/
+func (db *EntityDB) TryCreate(eid Entity, name string) (interface{}, error) {
+    manager, err := db.TryManager(name)
+    if err != nil { return nil, err }
+    if !db.Alive(eid) { return nil, &Error{Err: ErrDeadEntity, Entity: eid, Name: name} }
+    return manager.Create(eid), nil
+}
+
+/*
+TryGet retrieves a component for the given entity
+*/
+func (db *EntityDB) TryGet(eid Entity, name string) (interface{}, error) {
+    manager, err := db.TryManager(name)
+    if err != nil { return nil, err }
+    if !db.Alive(eid) { return nil, &Error{Err: ErrDeadEntity, Entity: eid, Name: name} }
+    if !manager.Has(eid) { return nil, &Error{Err: ErrNoComponent, Entity: eid, Name: name} }
+    return manager.Value(eid), nil
+}
+
+/*
+Lookup retrieves a component for the given entity, returning false if the
+component is unknown or the entity doesn't have it
+*/
+func (db *EntityDB) Lookup(eid Entity, name string) (interface{}, bool) {
+    comp, err := db.TryGet(eid, name)
+    return comp, err == nil
+}
+
+/*
+TrySet directly sets a component on to an entity, overwriting any previous
+component
+*/
+func (db *EntityDB) TrySet(eid Entity, name string, component interface{}) error {
+    manager, err := db.TryManager(name)
+    if err != nil { return err }
+    if !db.Alive(eid) { return &Error{Err: ErrDeadEntity, Entity: eid, Name: name} }
+    if !manager.Holds(component) { return &Error{Err: ErrWrongType, Entity: eid, Name: name} }
+    manager.Assign(eid, component)
+    return nil
+}
+
+/*
+TryRemove removes a component from the given entity.  Removing a component
+the entity doesn't have isn't an error.
+*/
+func (db *EntityDB) TryRemove(eid Entity, name string) error {
+    manager, err := db.TryManager(name)
+    if err != nil { return err }
+    manager.Remove(eid)
+    return nil
+}
+
+/*
+TryHas returns true if the passed entity has every given component
+*/
+func (db *EntityDB) TryHas(eid Entity, components ...string) (bool, error) {
+    for _, name := range components {
+        if _, err := db.TryManager(name); err != nil { return false, err }
+    }
+    return db.Has(eid, components...), nil
+}
+
+/*
+TrySearch returns a list of Entities that have the given list of components
+*/
+func (db *EntityDB) TrySearch(name string, components ...string) ([]Entity, error) {
+    if _, err := db.TryManager(name); err != nil { return nil, err }
+    for _, name := range components {
+        if _, err := db.TryManager(name); err != nil { return nil, err }
+    }
+    return db.Search(name, components...), nil
+}
+
+/*
+TryStoreOf retrieves the typed store registered for a component type
+*/
+func TryStoreOf[T any](db *EntityDB) (*Store[T], error) {
+    store, ok := db.stores[reflect.TypeFor[T]()]
+    if !ok { return nil, &Error{Err: ErrUnknownComponent, Name: reflect.TypeFor[T]().String()} }
+    return store.(*Store[T]), nil
+}
+
+/*
+TryResource retrieves the resource of the given type
+*/
+func TryResource[T any](db *EntityDB) (T, error) {
+    res, ok := db.resources[reflect.TypeFor[T]()]
+    if !ok { var zero T; return zero, &Error{Err: ErrUnknownResource, Name: reflect.TypeFor[T]().String()} }
+    return res.value.(T), nil
+}
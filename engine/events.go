@@ -0,0 +1,110 @@
+package engine
+
+
+/*
+EventKinds say what happened to an entity or component
+*/
+type EventKind int
+const (
+    EventAdd EventKind = iota       // A component was added to an entity
+    EventRemove                     // A component was removed from an entity
+    EventChange                     // A component was replaced or marked changed
+    EventDelete                     // An entity was deleted
+)
+
+/*
+Events describe a change to the database.  Old holds the component before
+the change and New after it, either being nil where it doesn't apply.  Delete
+events are sent before any of the entity's components are removed.
+*/
+type Event struct {
+    Kind EventKind
+    Entity Entity
+    Component string        // Empty for EventDelete
+    Old, New interface{}
+}
+
+/*
+Handlers are called synchronously whenever an event they subscribed to occurs
+*/
+type Handler func(*EntityDB, Event)
+
+/*
+Subscriptions identify a registered handler so it can be unsubscribed
+*/
+type Subscription uint64
+
+type eventKey struct {
+    kind EventKind
+    component string
+}
+type subscriber struct {
+    id Subscription
+    handler Handler
+}
+
+
+
+/*
+OnAdd subscribes a handler to additions of the named component
+*/
+func (db *EntityDB) OnAdd(name string, handler Handler) Subscription {
+    return db.subscribe(eventKey{EventAdd, name}, handler)
+}
+
+/*
+OnRemove subscribes a handler to removals of the named component
+*/
+func (db *EntityDB) OnRemove(name string, handler Handler) Subscription {
+    return db.subscribe(eventKey{EventRemove, name}, handler)
+}
+
+/*
+OnChange subscribes a handler to the named component being replaced on an
+entity that already had one, or being marked changed
+*/
+func (db *EntityDB) OnChange(name string, handler Handler) Subscription {
+    return db.subscribe(eventKey{EventChange, name}, handler)
+}
+
+/*
+OnDelete subscribes a handler to entities being deleted
+*/
+func (db *EntityDB) OnDelete(handler Handler) Subscription {
+    return db.subscribe(eventKey{EventDelete, ""}, handler)
+}
+
+/*
+Unsubscribe stops a handler from receiving any more events.  Handlers may
+unsubscribe while handling an event; the rest still see that event.
+*/
+func (db *EntityDB) Unsubscribe(sub Subscription) {
+    for key, list := range db.handlers {
+        // Build a new list, since emit may be walking the old one
+        kept := make([]subscriber, 0, len(list))
+        for _, other := range list {
+            if other.id != sub { kept = append(kept, other) }
+        }
+        db.handlers[key] = kept
+    }
+}
+
+func (db *EntityDB) subscribe(key eventKey, handler Handler) Subscription {
+    db.nextsub++
+    db.handlers[key] = append(db.handlers[key], subscriber{id: db.nextsub, handler: handler})
+    return db.nextsub
+}
+
+/*
+listening returns true if anything is subscribed to the event, letting callers
+avoid building events no one will see
+*/
+func (db *EntityDB) listening(kind EventKind, name string) bool {
+    return len(db.handlers[eventKey{kind, name}]) > 0
+}
+
+func (db *EntityDB) emit(event Event) {
+    for _, sub := range db.handlers[eventKey{event.Kind, event.Component}] {
+        sub.handler(db, event)
+    }
+}
@@ -0,0 +1,27 @@
+package engine
+
+
+import (
+    "testing"
+)
+
+
+func TestUnsubscribeWhileHandling(t *testing.T) {
+    db := NewEntityDB()
+    db.Register("tag", func() interface{} { return true }, func(v interface{}) interface{} { return v })
+
+    counts := make(map[string]int)
+    var first Subscription
+    first = db.OnAdd("tag", func(db *EntityDB, event Event) {
+        counts["A"]++
+        db.Unsubscribe(first)
+    })
+    db.OnAdd("tag", func(*EntityDB, Event) { counts["B"]++ })
+    db.OnAdd("tag", func(*EntityDB, Event) { counts["C"]++ })
+
+    db.New("tag")
+    if counts["A"] != 1 || counts["B"] != 1 || counts["C"] != 1 { t.Fatalf("first event reached %v, want each handler once", counts) }
+
+    db.New("tag")
+    if counts["A"] != 1 || counts["B"] != 2 || counts["C"] != 2 { t.Fatalf("second event reached %v, want B and C only", counts) }
+}
@@ -0,0 +1,125 @@
+package engine
+
+
+/*
+Indexes group the entities in a store by a key worked out from their
+components, like the map an entity is on or whether it's badly hurt, so
+they can be found without scanning the whole store.
+
+Indexes are kept up to date as components are set and removed.  Changes made
+through a pointer to a component aren't seen until the store is told about
+them with MarkChanged.  Reading an index counts as reading its store.
+*/
+type Index[T any, K comparable] struct {
+    store *Store[T]
+    key func(T) K
+    keys map[Entity]K
+    buckets map[K]*entitySet
+}
+
+/*
+NewIndex creates an index over every component in a store.  Indexes should
+be released once no longer needed.
+*/
+func NewIndex[T any, K comparable](store *Store[T], key func(T) K) *Index[T, K] {
+    index := &Index[T, K]{store: store, key: key, keys: make(map[Entity]K), buckets: make(map[K]*entitySet)}
+    for _, eid := range store.entities() { index.update(eid) }
+
+    db := store.db
+    db.indexes[store] = append(db.indexes[store], index)
+    return index
+}
+
+/*
+Release stops an index from being kept up to date
+*/
+func (index *Index[T, K]) Release() {
+    db := index.store.db
+    kept := db.indexes[index.store][:0]
+    for _, other := range db.indexes[index.store] {
+        if other != indexer(index) { kept = append(kept, other) }
+    }
+    db.indexes[index.store] = kept
+
+    index.keys = make(map[Entity]K)
+    index.buckets = make(map[K]*entitySet)
+}
+
+/*
+Lookup returns every entity whose component has the given key, in ascending
+order of entity index
+*/
+func (index *Index[T, K]) Lookup(key K) []Entity {
+    bucket, ok := index.buckets[key]
+    if !ok { return nil }
+    bucket.Sort()
+    return append([]Entity(nil), bucket.dense...)
+}
+
+/*
+Each calls fn for every entity whose component has the given key, along with
+that component.  Components must not be added to or removed from the store
+while iterating.
+*/
+func (index *Index[T, K]) Each(key K, fn func(Entity, T)) {
+    bucket, ok := index.buckets[key]
+    if !ok { return }
+    bucket.Sort()
+    for _, eid := range bucket.dense { fn(eid, index.store.Get(eid)) }
+}
+
+/*
+Count returns the number of entities whose component has the given key
+*/
+func (index *Index[T, K]) Count(key K) int {
+    bucket, ok := index.buckets[key]
+    if !ok { return 0 }
+    return len(bucket.dense)
+}
+
+/*
+Key returns the key an entity is indexed under, or false if it isn't in the index
+*/
+func (index *Index[T, K]) Key(eid Entity) (K, bool) {
+    key, ok := index.keys[eid]
+    return key, ok
+}
+
+/*
+update moves an entity to the bucket for its component's current key
+*/
+func (index *Index[T, K]) update(eid Entity) {
+    i := index.store.slot(eid)
+    var key K
+    if i >= 0 { key = index.key(index.store.data[i]) }
+
+    if old, ok := index.keys[eid]; ok {
+        if i >= 0 && old == key { return }
+
+        bucket := index.buckets[old]
+        bucket.Remove(eid)
+        if len(bucket.dense) == 0 { delete(index.buckets, old) }
+        delete(index.keys, eid)
+    }
+    if i < 0 { return }
+
+    bucket, ok := index.buckets[key]
+    if !ok {
+        bucket = &entitySet{}
+        index.buckets[key] = bucket
+    }
+    bucket.Add(eid)
+    index.keys[eid] = key
+}
+func (index *Index[T, K]) sort() {
+    for _, bucket := range index.buckets { bucket.Sort() }
+}
+
+/*
+indexers are the untyped view of an index, used by the EntityDB to keep
+every index on a store up to date
+*/
+type indexer interface {
+    update(eid Entity)
+    sort()
+}
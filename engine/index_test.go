@@ -0,0 +1,46 @@
+package engine
+
+
+import (
+    "slices"
+    "testing"
+)
+
+
+func TestIndexBuckets(t *testing.T) {
+    db := parallelDB(4)
+    eids := db.Search("health")
+    healths := StoreOf[*testHealth](db)
+    for i, eid := range eids { healths.Get(eid).Current = i % 2 }
+
+    index := NewIndex(healths, func(h *testHealth) int { return h.Current })
+    if got := index.Lookup(0); !slices.Equal(got, []Entity{eids[0], eids[2]}) { t.Fatalf("bucket 0 holds %v", got) }
+
+    // Changes through a pointer only move buckets once marked changed
+    healths.Get(eids[0]).Current = 5
+    if index.Count(5) != 0 { t.Fatal("index saw an unmarked change") }
+    healths.MarkChanged(eids[0])
+    if key, _ := index.Key(eids[0]); key != 5 || index.Count(0) != 1 || index.Count(5) != 1 { t.Fatal("marked change didn't move buckets") }
+
+    healths.Set(eids[1], &testHealth{Current: 5})
+    if got := index.Lookup(5); !slices.Equal(got, []Entity{eids[0], eids[1]}) { t.Fatalf("bucket 5 holds %v after set", got) }
+
+    db.Remove(eids[2], "health")
+    db.Delete(eids[3])
+    if _, ok := index.Key(eids[2]); ok || index.Count(0) != 0 || index.Count(1) != 0 { t.Fatal("removed components still indexed") }
+    if _, ok := index.buckets[0]; ok { t.Fatal("empty bucket kept") }
+
+    made := db.New("health")
+    if got := index.Lookup(0); !slices.Equal(got, []Entity{made}) { t.Fatalf("new component indexed as %v", got) }
+
+    var visited []Entity
+    index.Each(5, func(eid Entity, h *testHealth) {
+        if h.Current != 5 { t.Fatalf("entity %v in bucket 5 has %d", eid, h.Current) }
+        visited = append(visited, eid)
+    })
+    if len(visited) != 2 { t.Fatalf("Each visited %v", visited) }
+
+    index.Release()
+    healths.Set(made, &testHealth{Current: 9})
+    if index.Count(9) != 0 || len(db.indexes[healths]) != 0 { t.Fatal("released index still updated") }
+}
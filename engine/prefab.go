@@ -0,0 +1,92 @@
+package engine
+
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "sort"
+)
+
+
+/*
+Prefabs are named sets of components that entities can be spawned from.
+Unlike template entities, prefabs aren't part of the world, so they never turn
+up in searches and aren't saved with it.
+*/
+type prefab struct {
+    names []string          // sorted so spawning always adds components in the same order
+    comps map[string]interface{}
+}
+
+/*
+DefinePrefab defines a named prefab from a map of component names to components,
+replacing any prefab with the same name.  The prefab keeps its own copies of
+the components.
+*/
+func (db *EntityDB) DefinePrefab(name string, components map[string]interface{}) {
+    fab := prefab{comps: make(map[string]interface{})}
+    for comp, value := range components {
+        fab.names = append(fab.names, comp)
+        fab.comps[comp] = db.Manager(comp).Copy(value)
+    }
+    sort.Strings(fab.names)
+    db.prefabs[name] = fab
+}
+
+/*
+LoadPrefabs reads prefab definitions from JSON, mapping prefab names to objects
+that map component names to each component's JSON encoding:
+
+    {"bat": {"movement": {}, "art": {"Symbol": "b"}}}
+
+Components are decoded the same way as when loading a save.
+*/
+func (db *EntityDB) LoadPrefabs(r io.Reader) error {
+    var defs map[string]map[string]json.RawMessage
+    if err := json.NewDecoder(r).Decode(&defs); err != nil { return fmt.Errorf("EntityDB: Can't read prefabs: %w", err) }
+
+    for name, def := range defs {
+        components := make(map[string]interface{})
+        for comp, data := range def {
+            manager, ok := db.managers[comp]
+            if !ok { return fmt.Errorf("EntityDB: Prefab '%s' has unregistered component '%s'", name, comp) }
+
+            value, err := manager.Decode(data)
+            if err != nil { return fmt.Errorf("EntityDB: Can't load component '%s' of prefab '%s': %w", comp, name, err) }
+            components[comp] = value
+        }
+        db.DefinePrefab(name, components)
+    }
+    return nil
+}
+
+/*
+HasPrefab returns true if a prefab has been defined with the passed name
+*/
+func (db *EntityDB) HasPrefab(name string) bool {
+    _, ok := db.prefabs[name]
+    return ok
+}
+
+/*
+Spawn creates a new entity with a copy of every component in the named prefab
+*/
+func (db *EntityDB) Spawn(name string) Entity {
+    fab := db.prefab(name)
+    eid := db.allocate()
+    fab.spawn(db, eid)
+    return eid
+}
+
+func (db *EntityDB) prefab(name string) prefab {
+    fab, ok := db.prefabs[name]
+    if !ok { panic(&Error{Err: ErrUnknownPrefab, Name: name}) }
+    return fab
+}
+func (fab prefab) spawn(db *EntityDB, eid Entity) {
+    for _, comp := range fab.names {
+        manager := db.managers[comp]
+        manager.Assign(eid, manager.Copy(fab.comps[comp]))
+    }
+}
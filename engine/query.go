@@ -0,0 +1,244 @@
+package engine
+
+
+import (
+    "sync"
+)
+
+
+/*
+Queries select entities by the components they have.  An entity matches a
+query if it has every required component and none of the excluded ones;
+optional components don't affect matching but are handed to EachWith along
+with the required ones.
+
+Queries scan the database each time they are iterated unless cached, in which
+case the matching entities are kept up to date as components come and go.
+*/
+type Query struct {
+    db *EntityDB
+    with, without, optional []manager
+    row []interface{}
+
+    cached bool
+    matches entitySet
+}
+
+/*
+Query creates a query for entities with all of the given components
+*/
+func (db *EntityDB) Query(name string, components ...string) *Query {
+    query := &Query{db: db}
+    query.with = append(query.with, db.Manager(name))
+    for _, name := range components { query.with = append(query.with, db.Manager(name)) }
+    return query
+}
+
+/*
+Without excludes entities with any of the given components from the query
+*/
+func (query *Query) Without(components ...string) *Query {
+    for _, name := range components {
+        store := query.db.Manager(name)
+        query.without = append(query.without, store)
+        if query.cached { query.watch(store) }
+    }
+    if query.cached { query.rebuild() }
+    return query
+}
+
+/*
+Optional adds components to pass to EachWith if the entity has them
+*/
+func (query *Query) Optional(components ...string) *Query {
+    for _, name := range components { query.optional = append(query.optional, query.db.Manager(name)) }
+    return query
+}
+
+/*
+Cache makes the query keep its results, updating them whenever components
+it depends on are added or removed.  Cached queries should be released once
+no longer needed.  Caching and releasing change the database the query was
+made from, so need a write lock when it's shared through a SyncDB.
+*/
+func (query *Query) Cache() *Query {
+    if query.cached { return query }
+    query.cached = true
+
+    for _, store := range query.with { query.watch(store) }
+    for _, store := range query.without { query.watch(store) }
+    query.rebuild()
+    return query
+}
+
+/*
+Release stops a cached query from being kept up to date
+*/
+func (query *Query) Release() {
+    if !query.cached { return }
+    query.cached = false
+
+    for store, list := range query.db.queries {
+        kept := list[:0]
+        for _, other := range list {
+            if other != query { kept = append(kept, other) }
+        }
+        query.db.queries[store] = kept
+    }
+    query.matches.Clear()
+}
+
+/*
+Matches returns true if the passed entity matches the query
+*/
+func (query *Query) Matches(eid Entity) bool {
+    if query.cached { return query.matches.Has(eid) }
+    return query.test(eid)
+}
+
+/*
+Iter returns an iterator over the entities matching the query, in ascending
+order of entity index.  Components must not be added or removed while iterating.
+*/
+func (query *Query) Iter() QueryIter {
+    if query.cached {
+        query.matches.Sort()
+        return QueryIter{query: query, list: query.matches.dense}
+    }
+
+    // Walk the smallest required store, filtering out the rest
+    base := query.with[0]
+    for _, store := range query.with[1:] {
+        if len(store.entities()) < len(base.entities()) { base = store }
+    }
+    return QueryIter{query: query, list: base.entities()}
+}
+
+/*
+Each calls fn for every entity matching the query
+*/
+func (query *Query) Each(fn func(Entity)) {
+    for it := query.Iter(); it.Next(); {
+        fn(it.Entity())
+    }
+}
+
+/*
+EachParallel calls fn for every entity matching the query, splitting them
+between the given number of goroutines.  fn must be safe to call concurrently
+and must only make structural changes through the command buffer.
+*/
+func (query *Query) EachParallel(workers int, fn func(Entity)) {
+    list := query.Iter().list
+    if workers < 1 { workers = 1 }
+    size := (len(list) + workers - 1) / workers
+
+    var wait sync.WaitGroup
+    for start := 0; start < len(list); start += size {
+        end := min(start+size, len(list))
+
+        wait.Add(1)
+        go func(it QueryIter) {
+            defer wait.Done()
+            for it.Next() { fn(it.Entity()) }
+        }(QueryIter{query: query, list: list[start:end]})
+    }
+    wait.Wait()
+}
+
+/*
+EachWith calls fn for every entity matching the query along with its required
+components followed by its optional ones, which are nil when missing.  The
+component slice is reused between calls.
+*/
+func (query *Query) EachWith(fn func(Entity, []interface{})) {
+    if query.row == nil { query.row = make([]interface{}, len(query.with)+len(query.optional)) }
+    row := query.row[:len(query.with)+len(query.optional)]
+
+    for it := query.Iter(); it.Next(); {
+        eid := it.Entity()
+        for i, store := range query.with { row[i] = store.Value(eid) }
+        for i, store := range query.optional { row[len(query.with)+i] = store.Value(eid) }
+        fn(eid, row)
+    }
+}
+
+/*
+Entities returns a list of every entity matching the query
+*/
+func (query *Query) Entities() []Entity {
+    list := make([]Entity, 0)
+    for it := query.Iter(); it.Next(); {
+        list = append(list, it.Entity())
+    }
+    return list
+}
+
+/*
+Count returns the number of entities matching the query
+*/
+func (query *Query) Count() int {
+    if query.cached { return len(query.matches.dense) }
+
+    count := 0
+    for it := query.Iter(); it.Next(); { count++ }
+    return count
+}
+
+func (query *Query) watch(store manager) {
+    query.db.queries[store] = append(query.db.queries[store], query)
+}
+func (query *Query) test(eid Entity) bool {
+    for _, store := range query.with {
+        if !store.Has(eid) { return false }
+    }
+    for _, store := range query.without {
+        if store.Has(eid) { return false }
+    }
+    return true
+}
+func (query *Query) update(eid Entity) {
+    if query.test(eid) {
+        query.matches.Add(eid)
+    } else {
+        query.matches.Remove(eid)
+    }
+}
+func (query *Query) rebuild() {
+    query.matches.Clear()
+    for _, eid := range query.with[0].entities() { query.update(eid) }
+}
+
+
+
+/*
+QueryIters step through the results of a query without allocating
+*/
+type QueryIter struct {
+    query *Query
+    list []Entity
+    i int
+    eid Entity
+}
+
+/*
+Next advances to the next matching entity, returning false once there are none left
+*/
+func (it *QueryIter) Next() bool {
+    for it.i < len(it.list) {
+        eid := it.list[it.i]
+        it.i++
+        if it.query.cached || it.query.test(eid) {
+            it.eid = eid
+            return true
+        }
+    }
+    return false
+}
+
+/*
+Entity returns the entity the iterator is currently on
+*/
+func (it *QueryIter) Entity() Entity {
+    return it.eid
+}
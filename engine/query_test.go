@@ -0,0 +1,65 @@
+package engine
+
+
+import (
+    "slices"
+    "testing"
+)
+
+
+/*
+checkQuery compares a query's results with what scanning the database finds
+*/
+func checkQuery(t *testing.T, db *EntityDB, query *Query, step string) {
+    t.Helper()
+    var want []Entity
+    for _, eid := range db.Search("health") {
+        if db.Has(eid, "attack") && !db.Has(eid, "tag") { want = append(want, eid) }
+    }
+    if got := query.Entities(); !slices.Equal(got, want) { t.Fatalf("%s: query found %v, want %v", step, got, want) }
+    if query.Count() != len(want) { t.Fatalf("%s: query counted %d, want %d", step, query.Count(), len(want)) }
+}
+
+func TestCachedQuery(t *testing.T) {
+    db := parallelDB(6)
+    eids := db.Search("health")
+    db.Set(eids[0], "tag", true)
+
+    cached := db.Query("health", "attack").Without("tag").Cache()
+    scanned := db.Query("health", "attack").Without("tag")
+    checkQuery(t, db, cached, "start")
+
+    db.Remove(eids[1], "attack")
+    checkQuery(t, db, cached, "remove")
+    db.Set(eids[1], "attack", &testAttack{})
+    checkQuery(t, db, cached, "set")
+    db.Set(eids[2], "tag", true)
+    checkQuery(t, db, cached, "exclude")
+    db.Remove(eids[0], "tag")
+    checkQuery(t, db, cached, "include")
+    db.Delete(eids[3])
+    checkQuery(t, db, cached, "delete")
+    made := db.New("attack", "health")
+    checkQuery(t, db, cached, "create")
+    if !cached.Matches(made) || cached.Matches(eids[2]) { t.Fatal("Matches disagrees with the results") }
+    if !slices.Equal(cached.Entities(), scanned.Entities()) { t.Fatal("cached and scanned queries disagree") }
+
+    // Released queries go back to scanning, and stop being updated
+    cached.Release()
+    db.Remove(made, "attack")
+    if len(db.queries[db.Manager("attack")]) != 0 || len(cached.matches.dense) != 0 { t.Fatal("released query still kept") }
+    checkQuery(t, db, cached, "released")
+}
+
+func TestQueryEachWith(t *testing.T) {
+    db := parallelDB(0)
+    both, plain := db.New("health", "attack"), db.New("health")
+    StoreOf[*testHealth](db).Get(both).Current = 1
+
+    seen := make(map[Entity][]interface{})
+    db.Query("health").Optional("attack").EachWith(func(eid Entity, row []interface{}) {
+        seen[eid] = append([]interface{}(nil), row...)
+    })
+    if len(seen) != 2 || seen[both][0].(*testHealth).Current != 1 || seen[both][1] == nil { t.Fatalf("row for %v is %v", both, seen[both]) }
+    if seen[plain][1] != nil { t.Fatalf("missing optional component is %v, want nil", seen[plain][1]) }
+}
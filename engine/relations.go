@@ -0,0 +1,165 @@
+package engine
+
+
+import (
+    "fmt"
+)
+
+
+/*
+ChildOf is the relation linking a child entity to its parent, like a sword
+to the player carrying it.  An entity can have at most one parent, so parents
+should be set with SetParent rather than Relate.
+*/
+const ChildOf = "childof"
+
+/*
+relations are named, directed links between entities.  Each link is kept
+from both ends so either side can be looked up quickly.
+*/
+type relation struct {
+    db *EntityDB
+    targets map[Entity][]Entity     // from -> every to
+    sources map[Entity][]Entity     // to -> every from
+}
+func newRelation(db *EntityDB) *relation {
+    return &relation{db: db, targets: make(map[Entity][]Entity), sources: make(map[Entity][]Entity)}
+}
+
+func (rel *relation) link(from, to Entity) {
+    for _, eid := range rel.targets[from] {
+        if eid == to { return }
+    }
+    rel.targets[from] = append(rel.targets[from], to)
+    rel.sources[to] = append(rel.sources[to], from)
+    rel.db.record(func() { rel.unlink(from, to) })
+}
+func (rel *relation) unlink(from, to Entity) {
+    targets := without(rel.targets[from], to)
+    if len(targets) == len(rel.targets[from]) { return }
+
+    rel.targets[from] = targets
+    if len(rel.targets[from]) == 0 { delete(rel.targets, from) }
+    rel.sources[to] = without(rel.sources[to], from)
+    if len(rel.sources[to]) == 0 { delete(rel.sources, to) }
+    rel.db.record(func() { rel.link(from, to) })
+}
+func (rel *relation) targetsOf(from Entity) []Entity {
+    if rel == nil { return nil }
+    return rel.targets[from]
+}
+func (rel *relation) sourcesOf(to Entity) []Entity {
+    if rel == nil { return nil }
+    return rel.sources[to]
+}
+func (rel *relation) drop(eid Entity) {
+    for _, to := range append([]Entity(nil), rel.targets[eid]...) { rel.unlink(eid, to) }
+    for _, from := range append([]Entity(nil), rel.sources[eid]...) { rel.unlink(from, eid) }
+}
+
+func without(list []Entity, eid Entity) []Entity {
+    for i, other := range list {
+        if other == eid { return append(list[:i:i], list[i+1:]...) }
+    }
+    return list
+}
+
+
+
+/*
+DeleteOptions change what else gets deleted along with an entity
+*/
+type DeleteOption struct {
+    relation string
+}
+
+/*
+Cascade deletes every entity related to the deleted entity through the named
+relation, along with everything related to those, and so on
+*/
+func Cascade(relation string) DeleteOption {
+    return DeleteOption{relation: relation}
+}
+
+/*
+CascadeChildren deletes an entity's children, their children, and so on
+*/
+var CascadeChildren = Cascade(ChildOf)
+
+
+
+/*
+Relate links from to to through the named relation
+*/
+func (db *EntityDB) Relate(name string, from, to Entity) {
+    if !db.Alive(from) || !db.Alive(to) { panic(fmt.Sprintf("EntityDB: Can't relate dead entity %d or %d", from, to)) }
+
+    rel, ok := db.relations[name]
+    if !ok {
+        rel = newRelation(db)
+        db.relations[name] = rel
+    }
+    rel.link(from, to)
+}
+
+/*
+Unrelate removes the named relation from from to to, if there is one
+*/
+func (db *EntityDB) Unrelate(name string, from, to Entity) {
+    if rel, ok := db.relations[name]; ok { rel.unlink(from, to) }
+}
+
+/*
+Related returns every entity from is linked to through the named relation
+*/
+func (db *EntityDB) Related(name string, from Entity) []Entity {
+    return append([]Entity(nil), db.relations[name].targetsOf(from)...)
+}
+
+/*
+RelatedTo returns every entity linked to to through the named relation
+*/
+func (db *EntityDB) RelatedTo(name string, to Entity) []Entity {
+    return append([]Entity(nil), db.relations[name].sourcesOf(to)...)
+}
+
+/*
+SetParent makes child a child of parent, replacing any previous parent.  A
+zero parent leaves the child without one.  Panics if parent is child or one
+of its descendants.
+*/
+func (db *EntityDB) SetParent(child, parent Entity) {
+    for ancestor := parent; ancestor != 0; ancestor = db.Parent(ancestor) {
+        if ancestor == child { panic(fmt.Sprintf("EntityDB: Entity %d can't be its own ancestor", child)) }
+    }
+
+    if old := db.Parent(child); old != 0 { db.Unrelate(ChildOf, child, old) }
+    if parent != 0 { db.Relate(ChildOf, child, parent) }
+}
+
+/*
+Parent returns the parent of an entity, or zero if it has none
+*/
+func (db *EntityDB) Parent(child Entity) Entity {
+    parents := db.relations[ChildOf].targetsOf(child)
+    if len(parents) == 0 { return 0 }
+    return parents[0]
+}
+
+/*
+Children returns every child of an entity
+*/
+func (db *EntityDB) Children(parent Entity) []Entity {
+    return db.RelatedTo(ChildOf, parent)
+}
+
+/*
+ChildrenWith returns every child of an entity that has all the given components
+*/
+func (db *EntityDB) ChildrenWith(parent Entity, components ...string) []Entity {
+    children := make([]Entity, 0)
+    for _, child := range db.relations[ChildOf].sourcesOf(parent) {
+        if db.Has(child, components...) { children = append(children, child) }
+    }
+    return children
+}
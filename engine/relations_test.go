@@ -0,0 +1,66 @@
+package engine
+
+
+import (
+    "slices"
+    "testing"
+)
+
+
+func TestRelations(t *testing.T) {
+    db := parallelDB(3)
+    eids := db.Search("health")
+    db.Relate("likes", eids[0], eids[1])
+    db.Relate("likes", eids[0], eids[2])
+    db.Relate("likes", eids[0], eids[1])
+
+    if got := db.Related("likes", eids[0]); !slices.Equal(got, []Entity{eids[1], eids[2]}) { t.Fatalf("related %v", got) }
+    if got := db.RelatedTo("likes", eids[2]); !slices.Equal(got, []Entity{eids[0]}) { t.Fatalf("related to %v", got) }
+
+    db.Unrelate("likes", eids[0], eids[1])
+    if got := db.Related("likes", eids[0]); !slices.Equal(got, []Entity{eids[2]}) { t.Fatalf("related %v after unrelating", got) }
+
+    // Deleting either end drops the link
+    db.Delete(eids[2])
+    if len(db.Related("likes", eids[0])) != 0 || len(db.relations["likes"].sources) != 0 { t.Fatal("relation to a deleted entity kept") }
+}
+
+func TestParents(t *testing.T) {
+    db := parallelDB(0)
+    player, sword, gem, other := db.New(), db.New("attack"), db.New(), db.New()
+    db.SetParent(sword, player)
+    db.SetParent(gem, sword)
+
+    if db.Parent(gem) != sword || !slices.Equal(db.Children(player), []Entity{sword}) { t.Fatal("parents not set") }
+    if got := db.ChildrenWith(player, "attack"); !slices.Equal(got, []Entity{sword}) { t.Fatalf("children with attack %v", got) }
+
+    db.SetParent(sword, other)
+    if db.Parent(sword) != other || len(db.Children(player)) != 0 { t.Fatal("new parent didn't replace the old one") }
+    db.SetParent(sword, 0)
+    if db.Parent(sword) != 0 || len(db.Children(other)) != 0 { t.Fatal("zero parent didn't clear the parent") }
+
+    db.SetParent(sword, player)
+    defer func() {
+        if recover() == nil { t.Fatal("entity made its own ancestor") }
+    }()
+    db.SetParent(player, gem)
+}
+
+func TestDeleteCascade(t *testing.T) {
+    db := parallelDB(0)
+    player, sword, gem, bystander := db.New(), db.New(), db.New(), db.New()
+    db.SetParent(sword, player)
+    db.SetParent(gem, sword)
+    db.Relate("likes", bystander, player)
+
+    // Only the children cascade, not every relation
+    db.Delete(player, CascadeChildren)
+    if db.Alive(player) || db.Alive(sword) || db.Alive(gem) { t.Fatal("cascade left descendants alive") }
+    if !db.Alive(bystander) || len(db.Related("likes", bystander)) != 0 { t.Fatal("cascade followed the wrong relation") }
+
+    // Without cascading, children are only orphaned
+    parent, child := db.New(), db.New()
+    db.SetParent(child, parent)
+    db.Delete(parent)
+    if !db.Alive(child) || db.Parent(child) != 0 { t.Fatal("deleting a parent without cascading didn't orphan its child") }
+}
@@ -0,0 +1,77 @@
+package engine
+
+
+import (
+    "encoding/json"
+    "fmt"
+    "reflect"
+)
+
+
+/*
+Resources are values that belong to the whole world rather than to any one
+entity, like the turn counter or the random number generator.  There is at
+most one resource of each type, and each has a name used to save it.
+Resources are saved and loaded with the rest of the database and setting one
+is undone by a rollback, though changes made through a pointer aren't.
+*/
+type resource struct {
+    name string
+    value interface{}
+    decode func([]byte) (interface{}, error)
+}
+
+/*
+RegisterResource adds a resource to the database with a starting value
+*/
+func RegisterResource[T any](db *EntityDB, name string, value T) {
+    kind := reflect.TypeFor[T]()
+    if _, ok := db.resources[kind]; ok { panic(fmt.Sprintf("EntityDB: A resource is already registered for type %v", kind)) }
+    for _, other := range db.resources {
+        if other.name == name { panic(fmt.Sprintf("EntityDB: A resource is already registered named '%s'", name)) }
+    }
+
+    decode := func(data []byte) (interface{}, error) {
+        var value T
+        err := json.Unmarshal(data, &value)
+        return value, err
+    }
+    db.resources[kind] = &resource{name: name, value: value, decode: decode}
+}
+
+/*
+Resource retrieves the resource of the given type
+*/
+func Resource[T any](db *EntityDB) T {
+    return db.resource(reflect.TypeFor[T]()).value.(T)
+}
+
+/*
+SetResource replaces the resource of the given type
+*/
+func SetResource[T any](db *EntityDB, value T) {
+    res := db.resource(reflect.TypeFor[T]())
+    old := res.value
+    res.value = value
+    db.record(func() { res.value = old })
+}
+
+/*
+HasResource returns true if a resource of the given type is registered
+*/
+func HasResource[T any](db *EntityDB) bool {
+    _, ok := db.resources[reflect.TypeFor[T]()]
+    return ok
+}
+
+func (db *EntityDB) resource(kind reflect.Type) *resource {
+    res, ok := db.resources[kind]
+    if !ok { panic(&Error{Err: ErrUnknownResource, Name: kind.String()}) }
+    return res
+}
+func (db *EntityDB) namedResource(name string) *resource {
+    for _, res := range db.resources {
+        if res.name == name { return res }
+    }
+    return nil
+}
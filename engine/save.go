@@ -0,0 +1,160 @@
+package engine
+
+
+import (
+    "cmp"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "maps"
+    "slices"
+)
+
+
+/*
+SaveVersion is the version of the save format written by Save.  Load refuses
+to read saves from newer versions, and migrates older ones.  Versions go up
+whenever the meaning of saved components changes, not just the snapshot:
+
+    2: relations
+    3: resources
+    4: maps split into layers
+    5: terrain tiles decide what can pass
+*/
+const SaveVersion = 5
+
+/*
+Migrations upgrade a database just loaded from a save older than SaveVersion,
+given the version it was saved with
+*/
+type Migration func(db *EntityDB, version int) error
+
+/*
+Migrate adds a migration to run whenever an older save is loaded.  Migrations
+run in the order they were added, once everything in the save has loaded.
+*/
+func (db *EntityDB) Migrate(migration Migration) {
+    db.migrations = append(db.migrations, migration)
+}
+
+/*
+snapshots are the on-disk form of an EntityDB.  Components are encoded with
+encoding/json, so components with unexported state or interface fields must
+implement json.Marshaler and json.Unmarshaler themselves.
+*/
+type snapshot struct {
+    Version int
+    NextID uint32
+    Generations []uint32
+    Free []uint32
+    Entities []Entity
+    Components map[string]map[Entity]json.RawMessage
+    Relations map[string][][2]Entity     // Added in version 2
+    Resources map[string]json.RawMessage // Added in version 3
+}
+
+/*
+Save writes every entity and component in the database to w
+*/
+func (db *EntityDB) Save(w io.Writer) error {
+    db.settle()
+    snap := snapshot{
+        Version: SaveVersion,
+        NextID: db.nextid,
+        Generations: db.generations,
+        Free: db.free,
+        Entities: db.alive.dense,
+        Components: make(map[string]map[Entity]json.RawMessage),
+    }
+
+    for name, manager := range db.managers {
+        comps := make(map[Entity]json.RawMessage)
+        for _, eid := range manager.entities() {
+            data, err := json.Marshal(manager.Value(eid))
+            if err != nil { return fmt.Errorf("EntityDB: Can't save component '%s' of entity %d: %w", name, eid, err) }
+            comps[eid] = data
+        }
+        snap.Components[name] = comps
+    }
+
+    snap.Relations = make(map[string][][2]Entity)
+    for name, rel := range db.relations {
+        links := make([][2]Entity, 0)
+        for _, from := range db.alive.dense {
+            for _, to := range rel.targets[from] { links = append(links, [2]Entity{from, to}) }
+        }
+        if len(links) > 0 { snap.Relations[name] = links }
+    }
+
+    snap.Resources = make(map[string]json.RawMessage)
+    for _, res := range db.resources {
+        data, err := json.Marshal(res.value)
+        if err != nil { return fmt.Errorf("EntityDB: Can't save resource '%s': %w", res.name, err) }
+        snap.Resources[res.name] = data
+    }
+
+    return json.NewEncoder(w).Encode(&snap)
+}
+
+/*
+Load reads a database written by Save from r.  The database must be empty,
+and must have every component and resource in the save registered.
+Resources missing from the save keep their starting values.
+*/
+func (db *EntityDB) Load(r io.Reader) error {
+    if len(db.alive.dense) > 0 || db.nextid > 1 { return errors.New("EntityDB: Can only load into an empty database") }
+
+    var snap snapshot
+    if err := json.NewDecoder(r).Decode(&snap); err != nil { return fmt.Errorf("EntityDB: Can't read save: %w", err) }
+    if snap.Version > SaveVersion { return fmt.Errorf("EntityDB: Save version %d is newer than %d", snap.Version, SaveVersion) }
+    if len(snap.Generations) != int(snap.NextID) { return errors.New("EntityDB: Save has a corrupt entity table") }
+
+    // Restore the entity allocator before any components, since components
+    //  can only be added to living entities
+    db.nextid = snap.NextID
+    db.generations = snap.Generations
+    db.free = snap.Free
+    for _, eid := range snap.Entities { db.alive.Add(eid) }
+
+    for name := range snap.Components {
+        if _, ok := db.managers[name]; !ok { return fmt.Errorf("EntityDB: Save has unregistered component '%s'", name) }
+    }
+
+    // Load components in a fixed order so any handlers see the same events
+    //  every time the save is loaded
+    for _, manager := range db.order {
+        name, comps := manager.Name(), snap.Components[manager.Name()]
+        eids := slices.SortedFunc(maps.Keys(comps), func(a, b Entity) int { return cmp.Compare(a.Index(), b.Index()) })
+
+        for _, eid := range eids {
+            if !db.Alive(eid) { return fmt.Errorf("EntityDB: Save has component '%s' on dead entity %d", name, eid) }
+
+            comp, err := manager.Decode(comps[eid])
+            if err != nil { return fmt.Errorf("EntityDB: Can't load component '%s' of entity %d: %w", name, eid, err) }
+            manager.Assign(eid, comp)
+        }
+    }
+
+    for name, links := range snap.Relations {
+        for _, link := range links {
+            if !db.Alive(link[0]) || !db.Alive(link[1]) { return fmt.Errorf("EntityDB: Save has relation '%s' on dead entity", name) }
+            db.Relate(name, link[0], link[1])
+        }
+    }
+
+    for name, data := range snap.Resources {
+        res := db.namedResource(name)
+        if res == nil { return fmt.Errorf("EntityDB: Save has unregistered resource '%s'", name) }
+
+        value, err := res.decode(data)
+        if err != nil { return fmt.Errorf("EntityDB: Can't load resource '%s': %w", name, err) }
+        res.value = value
+    }
+
+    if snap.Version == SaveVersion { return nil }
+    for _, migration := range db.migrations {
+        if err := migration(db, snap.Version); err != nil { return fmt.Errorf("EntityDB: Can't migrate save from version %d: %w", snap.Version, err) }
+    }
+    return nil
+}
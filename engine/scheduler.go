@@ -0,0 +1,288 @@
+package engine
+
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+
+/*
+Phases are the broad stages of a frame.  Every system in an earlier phase
+runs before any system in a later one.
+*/
+type Phase int
+const (
+    PhaseInput Phase = iota
+    PhaseAI
+    PhaseMovement
+    PhaseCombat
+    PhaseCleanup
+    PhaseRender
+)
+
+/*
+Systems are named functions run once per frame by a Scheduler.  Before and
+After name other systems this one must run before or after within the frame;
+names of systems that aren't registered are ignored.
+
+Reads and Writes name the components and resources a system uses, letting
+a parallel scheduler run systems at the same time when none of them write
+anything the others use.  Systems that declare neither always run alone.
+Systems that may run in parallel must make structural changes through the
+database's command buffer rather than directly.
+*/
+type System struct {
+    Name string
+    Phase Phase
+    Before, After []string
+    Reads, Writes []string
+    Run func(*EntityDB)
+}
+
+/*
+conflicts returns true if two systems can't safely run at the same time
+*/
+func (system *System) conflicts(other *System) bool {
+    if len(system.Reads)+len(system.Writes) == 0 || len(other.Reads)+len(other.Writes) == 0 { return true }
+    if contains(system.Before, other.Name) || contains(system.After, other.Name) { return true }
+    if contains(other.Before, system.Name) || contains(other.After, system.Name) { return true }
+
+    for _, name := range system.Writes {
+        if contains(other.Reads, name) || contains(other.Writes, name) { return true }
+    }
+    for _, name := range other.Writes {
+        if contains(system.Reads, name) { return true }
+    }
+    return false
+}
+
+func contains(list []string, name string) bool {
+    for _, other := range list {
+        if other == name { return true }
+    }
+    return false
+}
+
+/*
+SystemStats record how long a system has taken to run
+*/
+type SystemStats struct {
+    Name string
+    Runs int
+    Last, Total time.Duration
+}
+
+type scheduled struct {
+    System
+    index int
+    enabled bool
+    stats SystemStats
+}
+
+
+
+/*
+Schedulers run registered systems in phase order, respecting their declared
+ordering, and flush the database's command buffer after each one.  Parallel
+schedulers run neighbouring systems of the same phase together when their
+component accesses don't conflict, flushing after each group instead.
+*/
+type Scheduler struct {
+    Parallel bool
+
+    systems map[string]*scheduled
+    order []*scheduled      // nil whenever the order needs to be worked out again
+}
+func NewScheduler() *Scheduler {
+    return &Scheduler{systems: make(map[string]*scheduled)}
+}
+
+/*
+Add registers a system with the scheduler, enabled
+*/
+func (sched *Scheduler) Add(system System) {
+    if _, ok := sched.systems[system.Name]; ok { panic(fmt.Sprintf("Scheduler: System '%s' is already registered", system.Name)) }
+
+    sched.systems[system.Name] = &scheduled{System: system, index: len(sched.systems), enabled: true, stats: SystemStats{Name: system.Name}}
+    sched.order = nil
+}
+
+/*
+Enable and Disable turn a system on or off without changing its place in the order
+*/
+func (sched *Scheduler) Enable(name string) {
+    sched.system(name).enabled = true
+}
+func (sched *Scheduler) Disable(name string) {
+    sched.system(name).enabled = false
+}
+
+/*
+Uses adds to the components and resources a registered system reads and
+writes, for systems that run code plugged in from elsewhere, like AI
+controllers, which may use more than the system itself knows about
+*/
+func (sched *Scheduler) Uses(name string, reads, writes []string) {
+    system := sched.system(name)
+    system.Reads = append(system.Reads, reads...)
+    system.Writes = append(system.Writes, writes...)
+}
+
+/*
+Enabled returns true if the named system is registered and enabled
+*/
+func (sched *Scheduler) Enabled(name string) bool {
+    system, ok := sched.systems[name]
+    return ok && system.enabled
+}
+
+/*
+Run runs every enabled system once, in order
+*/
+func (sched *Scheduler) Run(db *EntityDB) {
+    order, err := sched.resolve()
+    if err != nil { panic(err.Error()) }
+
+    for i := 0; i < len(order); {
+        var group []*scheduled
+        group, i = sched.group(order, i)
+
+        if len(group) == 1 {
+            group[0].run(db)
+        } else {
+            db.settle()
+            var wait sync.WaitGroup
+            for _, system := range group {
+                wait.Add(1)
+                go func(system *scheduled) {
+                    defer wait.Done()
+                    system.run(db)
+                }(system)
+            }
+            wait.Wait()
+        }
+        db.Commands().Flush()
+    }
+}
+
+/*
+group picks out the enabled systems starting at order[i] that can run
+together, returning them and the index of the first system after them
+*/
+func (sched *Scheduler) group(order []*scheduled, i int) ([]*scheduled, int) {
+    group := make([]*scheduled, 0, 1)
+    for ; i < len(order); i++ {
+        system := order[i]
+        if !system.enabled { continue }
+        if len(group) > 0 && !sched.Parallel { break }
+        if len(group) > 0 && system.Phase != group[0].Phase { break }
+
+        compatible := true
+        for _, other := range group {
+            if system.conflicts(&other.System) { compatible = false }
+        }
+        if !compatible { break }
+        group = append(group, system)
+    }
+    return group, i
+}
+
+func (system *scheduled) run(db *EntityDB) {
+    start := time.Now()
+    system.Run(db)
+
+    system.stats.Runs++
+    system.stats.Last = time.Since(start)
+    system.stats.Total += system.stats.Last
+}
+
+/*
+Order returns the names of every system in the order they run, or an error
+if their constraints can't all be satisfied
+*/
+func (sched *Scheduler) Order() ([]string, error) {
+    order, err := sched.resolve()
+    if err != nil { return nil, err }
+
+    names := make([]string, len(order))
+    for i, system := range order { names[i] = system.Name }
+    return names, nil
+}
+
+/*
+Stats returns the timing of every system, in the order they run
+*/
+func (sched *Scheduler) Stats() []SystemStats {
+    order, err := sched.resolve()
+    if err != nil { return nil }
+
+    stats := make([]SystemStats, len(order))
+    for i, system := range order { stats[i] = system.stats }
+    return stats
+}
+
+func (sched *Scheduler) system(name string) *scheduled {
+    system, ok := sched.systems[name]
+    if !ok { panic(fmt.Sprintf("Scheduler: No system registered named '%s'", name)) }
+    return system
+}
+
+/*
+resolve sorts the systems so every system comes after those in earlier phases
+and those it is constrained to follow.  Ties go to the earliest phase, then the
+system registered first, so the order is always the same.
+*/
+func (sched *Scheduler) resolve() ([]*scheduled, error) {
+    if sched.order != nil { return sched.order, nil }
+
+    // Work out which systems must run before each system
+    after := make(map[*scheduled][]*scheduled)
+    for _, system := range sched.systems {
+        for _, name := range system.After {
+            if other, ok := sched.systems[name]; ok { after[system] = append(after[system], other) }
+        }
+        for _, name := range system.Before {
+            if other, ok := sched.systems[name]; ok { after[other] = append(after[other], system) }
+        }
+        for _, other := range sched.systems {
+            if other.Phase < system.Phase { after[system] = append(after[system], other) }
+        }
+    }
+
+    order := make([]*scheduled, 0, len(sched.systems))
+    placed := make(map[*scheduled]bool)
+    for len(order) < len(sched.systems) {
+        var next *scheduled
+        for _, system := range sched.systems {
+            if placed[system] || !allPlaced(after[system], placed) { continue }
+            if next == nil || system.Phase < next.Phase || (system.Phase == next.Phase && system.index < next.index) {
+                next = system
+            }
+        }
+
+        if next == nil {
+            stuck := make([]string, 0)
+            for _, system := range sched.systems {
+                if !placed[system] { stuck = append(stuck, system.Name) }
+            }
+            sort.Strings(stuck)
+            return nil, fmt.Errorf("Scheduler: Systems have conflicting order constraints: %s", strings.Join(stuck, ", "))
+        }
+        order = append(order, next)
+        placed[next] = true
+    }
+
+    sched.order = order
+    return order, nil
+}
+
+func allPlaced(systems []*scheduled, placed map[*scheduled]bool) bool {
+    for _, system := range systems {
+        if !placed[system] { return false }
+    }
+    return true
+}
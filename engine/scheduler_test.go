@@ -0,0 +1,127 @@
+package engine
+
+
+import (
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+
+type testHealth struct {
+    Current, Max int
+}
+type testAttack struct {
+    Damage int
+}
+
+func parallelDB(count int) *EntityDB {
+    db := NewEntityDB()
+    RegisterStore(db, "health", func() *testHealth { return &testHealth{} }, func(h *testHealth) *testHealth { tmp := *h; return &tmp })
+    RegisterStore(db, "attack", func() *testAttack { return &testAttack{} }, func(a *testAttack) *testAttack { tmp := *a; return &tmp })
+    RegisterStore(db, "tag", func() bool { return true }, func(v bool) bool { return v })
+    for i := 0; i < count; i++ { db.New("health", "attack") }
+    return db
+}
+
+func TestParallelGroups(t *testing.T) {
+    db := parallelDB(1000)
+    sched := NewScheduler()
+    sched.Parallel = true
+
+    // The combat systems meet in the middle, which only works if they run at once
+    meet := make(chan bool)
+    rendezvous := func(send bool) {
+        if send {
+            select {
+            case meet <- true:
+            case <-time.After(5*time.Second): t.Error("combat systems didn't run at the same time")
+            }
+            return
+        }
+        select {
+        case <-meet:
+        case <-time.After(5*time.Second): t.Error("combat systems didn't run at the same time")
+        }
+    }
+    sched.Add(System{Name: "heal", Phase: PhaseCombat, Writes: []string{"health"}, Run: func(db *EntityDB) {
+        rendezvous(true)
+        StoreOf[*testHealth](db).Each(func(eid Entity, health *testHealth) {
+            health.Current++
+            db.Commands().New("tag")
+        })
+    }})
+    sched.Add(System{Name: "sharpen", Phase: PhaseCombat, Writes: []string{"attack"}, Run: func(db *EntityDB) {
+        rendezvous(false)
+        StoreOf[*testAttack](db).Each(func(eid Entity, attack *testAttack) {
+            attack.Damage++
+            db.Commands().Remove(eid, "attack")
+        })
+    }})
+    sched.Add(System{Name: "count", Phase: PhaseCleanup, Reads: []string{"health", "attack"}, Run: func(db *EntityDB) {
+        if n := len(db.Search("attack")); n != 0 { t.Errorf("%d attacks left after the combat group flushed", n) }
+    }})
+
+    order, _ := sched.resolve()
+    if group, next := sched.group(order, 0); len(group) != 2 || next != 2 { t.Fatalf("combat systems grouped as %d systems, want 2", len(group)) }
+
+    for i := 0; i < 5; i++ { sched.Run(db) }
+    if len(db.Search("tag")) != 5000 { t.Fatalf("%d tags created, want 5000", len(db.Search("tag"))) }
+    StoreOf[*testHealth](db).Each(func(eid Entity, health *testHealth) {
+        if health.Current != 5 { t.Fatalf("entity %d healed %d times, want 5", eid, health.Current) }
+    })
+}
+
+func TestConflictingSystemsRunApart(t *testing.T) {
+    sched := NewScheduler()
+    sched.Parallel = true
+    sched.Add(System{Name: "write", Phase: PhaseCombat, Writes: []string{"health"}, Run: func(*EntityDB) {}})
+    sched.Add(System{Name: "read", Phase: PhaseCombat, Reads: []string{"health"}, Run: func(*EntityDB) {}})
+    sched.Add(System{Name: "undeclared", Phase: PhaseCombat, Run: func(*EntityDB) {}})
+
+    order, err := sched.resolve()
+    if err != nil { t.Fatal(err) }
+    for i := 0; i < len(order); {
+        var group []*scheduled
+        group, i = sched.group(order, i)
+        if len(group) != 1 { t.Fatalf("conflicting systems grouped together: %d systems", len(group)) }
+    }
+}
+
+func TestEachParallelCommands(t *testing.T) {
+    db := parallelDB(2000)
+    victims := db.Search("health")
+
+    var visited int64
+    healths := StoreOf[*testHealth](db)
+    db.Query("health", "attack").EachParallel(8, func(eid Entity) {
+        atomic.AddInt64(&visited, 1)
+        healths.Get(eid).Max = int(eid.Index())
+
+        buf := db.Commands()
+        tagged := buf.New("tag")
+        buf.Set(tagged, "attack", &testAttack{Damage: int(eid.Index())})
+        if eid.Index()%2 == 0 { buf.Delete(eid) }
+    })
+    if visited != 2000 { t.Fatalf("visited %d entities, want 2000", visited) }
+
+    db.Commands().Flush()
+    if n := len(db.Search("tag", "attack")); n != 2000 { t.Fatalf("%d tagged entities with attacks, want 2000", n) }
+    for _, eid := range victims {
+        if db.Alive(eid) == (eid.Index()%2 == 0) { t.Fatalf("entity %d alive: %v", eid, db.Alive(eid)) }
+        if db.Alive(eid) && healths.Get(eid).Max != int(eid.Index()) { t.Fatalf("entity %d lost its write", eid) }
+    }
+}
+
+func TestUsesSplitsGroups(t *testing.T) {
+    sched := NewScheduler()
+    sched.Parallel = true
+    sched.Add(System{Name: "act", Phase: PhaseAI, Reads: []string{"position"}, Writes: []string{"movement"}, Run: func(*EntityDB) {}})
+    sched.Add(System{Name: "paint", Phase: PhaseAI, Writes: []string{"art"}, Run: func(*EntityDB) {}})
+
+    order, _ := sched.resolve()
+    if group, _ := sched.group(order, 0); len(group) != 2 { t.Fatalf("independent systems grouped as %d systems, want 2", len(group)) }
+
+    sched.Uses("act", []string{"art"}, nil)
+    if group, _ := sched.group(order, 0); len(group) != 1 { t.Fatal("system reading art grouped with one writing it") }
+}
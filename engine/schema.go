@@ -0,0 +1,171 @@
+package engine
+
+
+import (
+    "math"
+    "reflect"
+)
+
+
+/*
+Schemas describe the fields of a registered component, found by reflecting on
+a newly created one, so that tools like entity inspectors, data loaders and
+save migrations can work with any component without knowing its type.  Only
+exported fields are described, including those promoted from embedded structs.
+*/
+type Schema struct {
+    Name string
+    Type reflect.Type       // The component's type, such as *Position
+    Fields []Field
+}
+
+/*
+Fields describe one exported field of a component
+*/
+type Field struct {
+    Name string
+    Type reflect.Type
+    Tag reflect.StructTag
+    Default interface{}     // The field's value in a newly created component
+    index []int
+}
+
+func newSchema(name string, comp interface{}) *Schema {
+    schema := &Schema{Name: name, Type: reflect.TypeOf(comp)}
+
+    value, ok := structOf(comp)
+    if !ok { return schema }
+    for _, field := range reflect.VisibleFields(value.Type()) {
+        if !field.IsExported() || field.Anonymous { continue }
+
+        def, err := value.FieldByIndexErr(field.Index)
+        info := Field{Name: field.Name, Type: field.Type, Tag: field.Tag, index: field.Index}
+        if err == nil { info.Default = def.Interface() }
+        schema.Fields = append(schema.Fields, info)
+    }
+    return schema
+}
+
+/*
+structOf finds the struct a component holds, looking through a pointer
+*/
+func structOf(comp interface{}) (reflect.Value, bool) {
+    value := reflect.ValueOf(comp)
+    if value.Kind() == reflect.Pointer {
+        if value.IsNil() { return value, false }
+        value = value.Elem()
+    }
+    return value, value.Kind() == reflect.Struct
+}
+
+/*
+Schema describes the fields of the named component
+*/
+func (db *EntityDB) Schema(name string) *Schema {
+    return db.Manager(name).Schema()
+}
+
+/*
+Schemas describes every registered component, in the order they were registered
+*/
+func (db *EntityDB) Schemas() []*Schema {
+    schemas := make([]*Schema, len(db.order))
+    for i, manager := range db.order { schemas[i] = manager.Schema() }
+    return schemas
+}
+
+/*
+Field looks up a field by name
+*/
+func (schema *Schema) Field(name string) (Field, bool) {
+    for _, field := range schema.Fields {
+        if field.Name == name { return field, true }
+    }
+    return Field{}, false
+}
+
+/*
+Get reads the named field of a component
+*/
+func (schema *Schema) Get(comp interface{}, name string) (interface{}, error) {
+    field, value, err := schema.lookup(comp, name)
+    if err != nil { return nil, err }
+
+    fvalue, err := value.FieldByIndexErr(field.index)
+    if err != nil { return nil, &Error{Err: ErrNoField, Name: schema.Name + "." + name} }
+    return fvalue.Interface(), nil
+}
+
+/*
+Set changes the named field of a component, which must be a pointer.  Numbers
+are converted to the field's type, so values decoded from JSON can be set
+directly, but only when they fit: a fraction or a number out of the field's
+range is the wrong type.  Components changed this way should be marked
+changed afterwards.
+*/
+func (schema *Schema) Set(comp interface{}, name string, value interface{}) error {
+    field, cvalue, err := schema.lookup(comp, name)
+    if err != nil { return err }
+
+    fvalue, err := cvalue.FieldByIndexErr(field.index)
+    if err != nil || !fvalue.CanSet() { return &Error{Err: ErrNoField, Name: schema.Name + "." + name} }
+
+    if value == nil {
+        fvalue.SetZero()
+        return nil
+    }
+    nvalue := reflect.ValueOf(value)
+    switch {
+    case nvalue.Type().AssignableTo(fvalue.Type()): fvalue.Set(nvalue)
+    case numeric(nvalue.Kind()) && numeric(fvalue.Kind()) && fits(nvalue, fvalue): fvalue.Set(nvalue.Convert(fvalue.Type()))
+    default: return &Error{Err: ErrWrongType, Name: schema.Name + "." + name}
+    }
+    return nil
+}
+
+func (schema *Schema) lookup(comp interface{}, name string) (Field, reflect.Value, error) {
+    if reflect.TypeOf(comp) != schema.Type { return Field{}, reflect.Value{}, &Error{Err: ErrWrongType, Name: schema.Name} }
+
+    field, ok := schema.Field(name)
+    if !ok { return Field{}, reflect.Value{}, &Error{Err: ErrNoField, Name: schema.Name + "." + name} }
+
+    value, ok := structOf(comp)
+    if !ok { return Field{}, reflect.Value{}, &Error{Err: ErrNoField, Name: schema.Name + "." + name} }
+    return field, value, nil
+}
+
+func numeric(kind reflect.Kind) bool {
+    return kind >= reflect.Int && kind <= reflect.Float64
+}
+
+/*
+fits returns true if a number converts to the type of field without losing anything
+*/
+func fits(value, field reflect.Value) bool {
+    // Work with the number as a float too, to find fractions and check ranges
+    var f float64
+    switch {
+    case value.CanInt(): f = float64(value.Int())
+    case value.CanUint(): f = float64(value.Uint())
+    default: f = value.Float()
+    }
+    if math.IsNaN(f) { return field.CanFloat() }
+
+    switch {
+    case field.CanInt():
+        if value.CanInt() { return !field.OverflowInt(value.Int()) }
+        if value.CanUint() { return value.Uint() <= math.MaxInt64 && !field.OverflowInt(int64(value.Uint())) }
+        return f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 && !field.OverflowInt(int64(f))
+    case field.CanUint():
+        if value.CanInt() { return value.Int() >= 0 && !field.OverflowUint(uint64(value.Int())) }
+        if value.CanUint() { return !field.OverflowUint(value.Uint()) }
+        return f == math.Trunc(f) && f >= 0 && f < math.MaxUint64 && !field.OverflowUint(uint64(f))
+    }
+
+    // Whole numbers must survive the trip through a float exactly
+    if field.OverflowFloat(f) { return false }
+    converted := value.Convert(field.Type())
+    if value.CanInt() { return f < math.MaxInt64 && converted.Convert(value.Type()).Int() == value.Int() }
+    if value.CanUint() { return f < math.MaxUint64 && converted.Convert(value.Type()).Uint() == value.Uint() }
+    return true
+}
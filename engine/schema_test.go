@@ -0,0 +1,50 @@
+package engine
+
+
+import (
+    "errors"
+    "math"
+    "testing"
+)
+
+
+type testNumbers struct {
+    Small uint8
+    Count int
+    Ratio float64
+    Half float32
+}
+
+func TestSchemaSetConversions(t *testing.T) {
+    db := NewEntityDB()
+    RegisterStore(db, "numbers", func() *testNumbers { return &testNumbers{} }, func(n *testNumbers) *testNumbers { tmp := *n; return &tmp })
+    schema := db.Schema("numbers")
+    comp := &testNumbers{}
+
+    good := []struct {
+        field string
+        value interface{}
+    }{
+        {"Small", 255.0}, {"Small", int64(7)}, {"Count", 2.0}, {"Count", -3.0}, {"Count", uint64(12)},
+        {"Ratio", 1.5}, {"Ratio", int64(1) << 53}, {"Half", 0.5}, {"Half", 16777216},
+    }
+    for _, test := range good {
+        if err := schema.Set(comp, test.field, test.value); err != nil { t.Errorf("setting %s to %v: %v", test.field, test.value, err) }
+    }
+    if comp.Small != 7 || comp.Count != 12 || comp.Ratio != 1<<53 || comp.Half != 16777216 { t.Fatalf("fields set to %+v", *comp) }
+
+    bad := []struct {
+        field string
+        value interface{}
+    }{
+        {"Small", 300.0}, {"Small", 1.5}, {"Small", -1}, {"Small", int64(256)}, {"Count", 1.5}, {"Count", math.Inf(1)},
+        {"Count", math.NaN()}, {"Count", uint64(math.MaxUint64)}, {"Count", 1e19}, {"Ratio", int64(1)<<53 + 1},
+        {"Half", 16777217}, {"Half", 1e39},
+    }
+    for _, test := range bad {
+        before := *comp
+        err := schema.Set(comp, test.field, test.value)
+        if !errors.Is(err, ErrWrongType) { t.Errorf("setting %s to %v gave %v, want ErrWrongType", test.field, test.value, err) }
+        if *comp != before { t.Errorf("setting %s to %v changed the component", test.field, test.value) }
+    }
+}
@@ -0,0 +1,80 @@
+package engine
+
+
+import (
+    "cmp"
+    "slices"
+)
+
+
+/*
+entitySets are packed sets of entities with constant time insertion, removal
+and membership tests.  Only one generation of each entity index can be in a
+set at a time.  Removing entities or adding them out of order leaves the set
+unsorted until Sort puts it back in ascending order of entity index.
+*/
+type entitySet struct {
+    sparse []uint32     // entity index -> dense slot+1, 0 meaning not in the set
+    dense []Entity
+    unsorted bool
+}
+
+/*
+sparseSlot looks up an entity's slot in a sparse array, returning -1 if
+the slot is empty or holds a different generation of the entity
+*/
+func sparseSlot(sparse []uint32, dense []Entity, eid Entity) int {
+    index := eid.Index()
+    if int(index) >= len(sparse) { return -1 }
+
+    i := int(sparse[index]) - 1
+    if i < 0 || dense[i] != eid { return -1 }
+    return i
+}
+
+/*
+sparseGrow makes sure a sparse array can hold the passed entity index
+*/
+func sparseGrow(sparse []uint32, index uint32) []uint32 {
+    if int(index) < len(sparse) { return sparse }
+
+    grown := make([]uint32, index+1, 2*(index+1))
+    copy(grown, sparse)
+    return grown[:cap(grown)]
+}
+
+func (set *entitySet) Has(eid Entity) bool {
+    return sparseSlot(set.sparse, set.dense, eid) >= 0
+}
+func (set *entitySet) Add(eid Entity) {
+    if set.Has(eid) { return }
+
+    if l := len(set.dense); l > 0 && set.dense[l-1].Index() > eid.Index() { set.unsorted = true }
+    set.sparse = sparseGrow(set.sparse, eid.Index())
+    set.dense = append(set.dense, eid)
+    set.sparse[eid.Index()] = uint32(len(set.dense))
+}
+func (set *entitySet) Remove(eid Entity) {
+    i := sparseSlot(set.sparse, set.dense, eid)
+    if i < 0 { return }
+
+    last := len(set.dense) - 1
+    moved := set.dense[last]
+    set.dense[i] = moved
+    set.sparse[moved.Index()] = uint32(i + 1)
+    set.sparse[eid.Index()] = 0
+    set.dense = set.dense[:last]
+    if i != last { set.unsorted = true }
+}
+func (set *entitySet) Clear() {
+    for _, eid := range set.dense { set.sparse[eid.Index()] = 0 }
+    set.dense = set.dense[:0]
+    set.unsorted = false
+}
+func (set *entitySet) Sort() {
+    if !set.unsorted { return }
+
+    slices.SortFunc(set.dense, func(a, b Entity) int { return cmp.Compare(a.Index(), b.Index()) })
+    for i, eid := range set.dense { set.sparse[eid.Index()] = uint32(i + 1) }
+    set.unsorted = false
+}
@@ -0,0 +1,319 @@
+package engine
+
+
+import (
+    "encoding/json"
+    "sort"
+    "sync"
+)
+
+
+/*
+managers are the untyped view of a component store, used by the EntityDB
+for operations that work across every registered component.
+*/
+type manager interface {
+    Name() string
+    Create(eid Entity) interface{}
+    Clone(src, dst Entity) interface{}
+    Copy(comp interface{}) interface{}
+    Value(eid Entity) interface{}
+    Assign(eid Entity, comp interface{})
+    MarkChanged(eid Entity)
+    Holds(comp interface{}) bool
+    Decode(data []byte) (interface{}, error)
+    Schema() *Schema
+    Remove(eid Entity)
+    Has(eid Entity) bool
+    Entities() []Entity
+    entities() []Entity
+    sort()
+}
+
+
+
+/*
+Stores hold every component of a single type, indexed by entity id.  Getting
+a component out of a store requires no type assertions.
+
+Components are kept in a sparse set: a sparse array maps entity ids to slots
+in a pair of densely packed arrays of entities and their components, so that
+iterating a store walks contiguous memory and never allocates.  Stores are
+iterated in ascending order of entity index, so that systems visit entities
+in the same order on every run of a seeded game.
+*/
+type Store[T any] struct {
+    db *EntityDB
+    name string
+    create func() T
+    clone func(T) T
+
+    sparse []uint32     // entity index -> dense slot+1, 0 meaning no component
+    dense []Entity
+    data []T
+    unsorted bool       // dense is out of order, fixed up before iterating
+
+    schema *Schema
+    schemaOnce sync.Once
+}
+func newStore[T any](db *EntityDB, name string, create func() T, clone func(T) T) *Store[T] {
+    return &Store[T]{db: db, name: name, create: create, clone: clone}
+}
+
+/*
+slot returns the index into the dense arrays for an entity, or -1
+*/
+func (store *Store[T]) slot(eid Entity) int {
+    return sparseSlot(store.sparse, store.dense, eid)
+}
+
+/*
+Name returns the name the store was registered under
+*/
+func (store *Store[T]) Name() string {
+    return store.name
+}
+
+/*
+Len returns the number of components in the store
+*/
+func (store *Store[T]) Len() int {
+    return len(store.dense)
+}
+
+/*
+Create creates a new empty component for the given entity and returns it
+*/
+func (store *Store[T]) Create(eid Entity) interface{} {
+    return store.New(eid)
+}
+
+/*
+New is the typed version of Create
+*/
+func (store *Store[T]) New(eid Entity) T {
+    comp := store.create()
+    store.Set(eid, comp)
+    return comp
+}
+
+/*
+Clone copies the component of src on to dst, returning the copy or nil
+if src has no component
+*/
+func (store *Store[T]) Clone(src, dst Entity) interface{} {
+    i := store.slot(src)
+    if i < 0 { return nil }
+
+    newc := store.clone(store.data[i])
+    store.Set(dst, newc)
+    return newc
+}
+
+/*
+Copy clones a component that isn't attached to any entity
+*/
+func (store *Store[T]) Copy(comp interface{}) interface{} {
+    return store.clone(store.typed(comp))
+}
+
+/*
+Get retrieves the component for an entity, or the zero value if it has none
+*/
+func (store *Store[T]) Get(eid Entity) T {
+    i := store.slot(eid)
+    if i < 0 { var zero T; return zero }
+    store.touch(eid, store.data[i])
+    return store.data[i]
+}
+
+/*
+Value retrieves the component for an entity as an interface, or nil
+if it has none
+*/
+func (store *Store[T]) Value(eid Entity) interface{} {
+    i := store.slot(eid)
+    if i < 0 { return nil }
+    store.touch(eid, store.data[i])
+    return store.data[i]
+}
+
+/*
+Lookup retrieves the component for an entity, returning false if it has none
+*/
+func (store *Store[T]) Lookup(eid Entity) (T, bool) {
+    i := store.slot(eid)
+    if i < 0 { var zero T; return zero, false }
+    store.touch(eid, store.data[i])
+    return store.data[i], true
+}
+
+/*
+TrySet sets the component for an entity, returning an error if the entity
+isn't alive
+*/
+func (store *Store[T]) TrySet(eid Entity, comp T) error {
+    if !store.Has(eid) && !store.db.Alive(eid) { return &Error{Err: ErrDeadEntity, Entity: eid, Name: store.name} }
+    store.Set(eid, comp)
+    return nil
+}
+
+/*
+Set sets the component for an entity, overwriting any previous component.
+Panics if the entity isn't alive.
+*/
+func (store *Store[T]) Set(eid Entity, comp T) {
+    if i := store.slot(eid); i >= 0 {
+        old := store.data[i]
+        store.data[i] = comp
+        store.db.record(func() { store.Set(eid, old) })
+        store.db.changed(store, eid, old, comp)
+        return
+    }
+    if !store.db.Alive(eid) { panic(&Error{Err: ErrDeadEntity, Entity: eid, Name: store.name}) }
+
+    if l := len(store.dense); l > 0 && store.dense[l-1].Index() > eid.Index() { store.unsorted = true }
+    store.sparse = sparseGrow(store.sparse, eid.Index())
+    store.dense = append(store.dense, eid)
+    store.data = append(store.data, comp)
+    store.sparse[eid.Index()] = uint32(len(store.dense))
+    store.db.record(func() { store.Remove(eid) })
+    store.db.added(store, eid, comp)
+}
+
+/*
+Assign is the untyped version of Set
+*/
+func (store *Store[T]) Assign(eid Entity, comp interface{}) {
+    store.Set(eid, store.typed(comp))
+}
+
+/*
+MarkChanged tells the store an entity's component was changed through its
+pointer, updating indexes and sending a change event with the component as
+both Old and New
+*/
+func (store *Store[T]) MarkChanged(eid Entity) {
+    i := store.slot(eid)
+    if i < 0 { return }
+    store.db.changed(store, eid, store.data[i], store.data[i])
+}
+
+/*
+Holds returns true if comp is the right type to be a component in this store
+*/
+func (store *Store[T]) Holds(comp interface{}) bool {
+    _, ok := comp.(T)
+    return ok
+}
+
+func (store *Store[T]) typed(comp interface{}) T {
+    typed, ok := comp.(T)
+    if !ok { panic(&Error{Err: ErrWrongType, Name: store.name}) }
+    return typed
+}
+
+/*
+Decode creates a new component and fills it in from JSON
+*/
+func (store *Store[T]) Decode(data []byte) (interface{}, error) {
+    comp := store.create()
+    if err := json.Unmarshal(data, &comp); err != nil { return nil, err }
+    return comp, nil
+}
+
+/*
+Schema describes the fields of the store's components
+*/
+func (store *Store[T]) Schema() *Schema {
+    store.schemaOnce.Do(func() { store.schema = newSchema(store.name, store.create()) })
+    return store.schema
+}
+
+/*
+Remove removes the component from an entity.  The last component in the
+store is moved into the freed slot to keep the arrays packed, and the store
+is sorted again the next time it's iterated.
+*/
+func (store *Store[T]) Remove(eid Entity) {
+    i := store.slot(eid)
+    if i < 0 { return }
+
+    old := store.data[i]
+    last := len(store.dense) - 1
+    moved := store.dense[last]
+    store.dense[i] = moved
+    store.data[i] = store.data[last]
+    store.sparse[moved.Index()] = uint32(i + 1)
+    store.sparse[eid.Index()] = 0
+
+    var zero T
+    store.data[last] = zero
+    store.dense = store.dense[:last]
+    store.data = store.data[:last]
+    if i != last { store.unsorted = true }
+    store.db.record(func() { store.Set(eid, old) })
+    store.db.removed(store, eid, old)
+}
+
+/*
+Has returns true if the entity has a component in this store
+*/
+func (store *Store[T]) Has(eid Entity) bool {
+    return store.slot(eid) >= 0
+}
+
+/*
+Each calls fn for every entity in the store along with its component.  Components
+must not be added to or removed from the store while iterating over it.
+*/
+func (store *Store[T]) Each(fn func(Entity, T)) {
+    store.sort()
+    for i, eid := range store.dense {
+        store.touch(eid, store.data[i])
+        fn(eid, store.data[i])
+    }
+}
+
+/*
+Entities returns a list of every entity with a component in this store
+*/
+func (store *Store[T]) Entities() []Entity {
+    return append([]Entity(nil), store.entities()...)
+}
+
+/*
+entities returns the store's own packed list of entities, which is only
+valid until the store is next modified
+*/
+func (store *Store[T]) entities() []Entity {
+    store.sort()
+    return store.dense
+}
+
+/*
+sort puts the store back in ascending order of entity index if adding or
+removing components has shuffled it
+*/
+func (store *Store[T]) sort() {
+    if !store.unsorted { return }
+
+    sort.Sort(byIndex[T]{store})
+    for i, eid := range store.dense { store.sparse[eid.Index()] = uint32(i + 1) }
+    store.unsorted = false
+}
+
+type byIndex[T any] struct {
+    store *Store[T]
+}
+func (order byIndex[T]) Len() int {
+    return len(order.store.dense)
+}
+func (order byIndex[T]) Less(i, j int) bool {
+    return order.store.dense[i].Index() < order.store.dense[j].Index()
+}
+func (order byIndex[T]) Swap(i, j int) {
+    dense, data := order.store.dense, order.store.data
+    dense[i], dense[j] = dense[j], dense[i]
+    data[i], data[j] = data[j], data[i]
+}
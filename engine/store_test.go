@@ -0,0 +1,113 @@
+package engine
+
+
+import (
+    "testing"
+)
+
+
+/*
+mapManager is the map-backed manager stores replaced, kept to benchmark against
+*/
+type mapManager struct {
+    comps map[Entity]interface{}
+}
+func (manager mapManager) Has(eid Entity) bool {
+    _, ok := manager.comps[eid]
+    return ok
+}
+func (manager mapManager) Entities() []Entity {
+    list := make([]Entity, 0, len(manager.comps))
+    for key := range manager.comps { list = append(list, key) }
+    return list
+}
+
+func mapSearch(base mapManager, others ...mapManager) []Entity {
+    list := base.Entities()
+    retval := make([]Entity, 0, len(list))
+    for _, eid := range list {
+        found := true
+        for _, other := range others { found = found && other.Has(eid) }
+        if found { retval = append(retval, eid) }
+    }
+    return retval
+}
+
+type benchPosition struct {
+    X, Y int64
+}
+
+const benchEntities = 10000
+
+/*
+benchDB fills a database with positions on every entity and health on every other one
+*/
+func benchDB() *EntityDB {
+    db := NewEntityDB()
+    RegisterStore(db, "position", func() *benchPosition { return &benchPosition{} }, func(p *benchPosition) *benchPosition { tmp := *p; return &tmp })
+    RegisterStore(db, "health", func() *int { return new(int) }, func(h *int) *int { tmp := *h; return &tmp })
+    for i := 0; i < benchEntities; i++ {
+        eid := db.New("position")
+        if i%2 == 0 { db.Create(eid, "health") }
+    }
+    return db
+}
+
+func benchMaps() (mapManager, mapManager) {
+    positions, health := mapManager{make(map[Entity]interface{})}, mapManager{make(map[Entity]interface{})}
+    for i := 0; i < benchEntities; i++ {
+        eid := Entity(i + 1)
+        positions.comps[eid] = &benchPosition{}
+        if i%2 == 0 { health.comps[eid] = new(int) }
+    }
+    return positions, health
+}
+
+
+
+func BenchmarkStoreEach(b *testing.B) {
+    store := StoreOf[*benchPosition](benchDB())
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        store.Each(func(eid Entity, pos *benchPosition) { pos.X++ })
+    }
+}
+
+func BenchmarkMapEach(b *testing.B) {
+    positions, _ := benchMaps()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        for _, comp := range positions.comps { comp.(*benchPosition).X++ }
+    }
+}
+
+func BenchmarkStoreSearch(b *testing.B) {
+    db := benchDB()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        if len(db.Search("position", "health")) != benchEntities/2 { b.Fatal("wrong number of matches") }
+    }
+}
+
+func BenchmarkMapSearch(b *testing.B) {
+    positions, health := benchMaps()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        if len(mapSearch(positions, health)) != benchEntities/2 { b.Fatal("wrong number of matches") }
+    }
+}
+
+func TestStoreIteration(t *testing.T) {
+    db := benchDB()
+    positions, health := benchMaps()
+
+    count := 0
+    StoreOf[*benchPosition](db).Each(func(Entity, *benchPosition) { count++ })
+    if count != len(positions.comps) { t.Fatalf("Each visited %d components, want %d", count, len(positions.comps)) }
+
+    found := db.Search("position", "health")
+    if len(found) != len(mapSearch(positions, health)) { t.Fatalf("Search found %d entities, want %d", len(found), len(health.comps)) }
+    for i := 1; i < len(found); i++ {
+        if found[i-1].Index() >= found[i].Index() { t.Fatal("Search results out of order") }
+    }
+}
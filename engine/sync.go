@@ -0,0 +1,129 @@
+package engine
+
+
+import (
+    "io"
+    "sync"
+)
+
+
+/*
+SyncDBs guard an EntityDB with a read/write lock so it can be shared between
+goroutines, such as the game loop and a background autosave or server.
+
+Any number of Read callbacks may run at once, but a Write callback runs alone.
+Read callbacks must not change the database or any component in it, and
+components must not be used once the callback that fetched them returns.
+Queries belong to whichever goroutine made them and shouldn't be shared.
+Caching or releasing a query, creating or releasing an index, and tracking
+or checkpointing changes all register with the database, so they change it
+and must only happen inside Write.
+The wrapped database must only be used through the SyncDB.  Writes leave the
+database sorted, so that readers iterating it never have to.
+
+A whole frame can be run under one lock with sync.Write(scheduler.Run).
+*/
+type SyncDB struct {
+    mu sync.RWMutex
+    db *EntityDB
+}
+func NewSyncDB(db *EntityDB) *SyncDB {
+    return &SyncDB{db: db}
+}
+
+/*
+Read calls fn with the database, sharing it with other readers
+*/
+func (sdb *SyncDB) Read(fn func(*EntityDB)) {
+    sdb.mu.RLock()
+    defer sdb.mu.RUnlock()
+    fn(sdb.db)
+}
+
+/*
+Write calls fn with the database, locking out every other reader and writer
+*/
+func (sdb *SyncDB) Write(fn func(*EntityDB)) {
+    sdb.mu.Lock()
+    defer sdb.mu.Unlock()
+    defer sdb.db.settle()
+    fn(sdb.db)
+}
+
+/*
+Alive returns true if the entity has been created and not yet deleted
+*/
+func (sdb *SyncDB) Alive(eid Entity) bool {
+    sdb.mu.RLock()
+    defer sdb.mu.RUnlock()
+    return sdb.db.Alive(eid)
+}
+
+/*
+Has returns true if the passed entity has every given component
+*/
+func (sdb *SyncDB) Has(eid Entity, components ...string) bool {
+    sdb.mu.RLock()
+    defer sdb.mu.RUnlock()
+    return sdb.db.Has(eid, components...)
+}
+
+/*
+Search returns a list of Entities that have the given list of components
+*/
+func (sdb *SyncDB) Search(name string, components ...string) []Entity {
+    sdb.mu.RLock()
+    defer sdb.mu.RUnlock()
+    return sdb.db.Search(name, components...)
+}
+
+/*
+New creates a new entity, optionally with the specified empty components
+*/
+func (sdb *SyncDB) New(components ...string) Entity {
+    sdb.mu.Lock()
+    defer sdb.mu.Unlock()
+    defer sdb.db.settle()
+    return sdb.db.New(components...)
+}
+
+/*
+Delete removes an entity from the database
+*/
+func (sdb *SyncDB) Delete(eid Entity, options ...DeleteOption) {
+    sdb.mu.Lock()
+    defer sdb.mu.Unlock()
+    defer sdb.db.settle()
+    sdb.db.Delete(eid, options...)
+}
+
+/*
+Set directly sets a component on to an entity, overwriting
+any previous component.
+*/
+func (sdb *SyncDB) Set(eid Entity, name string, component interface{}) {
+    sdb.mu.Lock()
+    defer sdb.mu.Unlock()
+    defer sdb.db.settle()
+    sdb.db.Set(eid, name, component)
+}
+
+/*
+Remove removes a component from the given entity
+*/
+func (sdb *SyncDB) Remove(eid Entity, name string) {
+    sdb.mu.Lock()
+    defer sdb.mu.Unlock()
+    defer sdb.db.settle()
+    sdb.db.Remove(eid, name)
+}
+
+/*
+Save writes the database to w while holding a read lock, so the game can keep
+reading but not changing the world while it saves
+*/
+func (sdb *SyncDB) Save(w io.Writer) error {
+    sdb.mu.RLock()
+    defer sdb.mu.RUnlock()
+    return sdb.db.Save(w)
+}
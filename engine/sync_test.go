@@ -0,0 +1,100 @@
+package engine
+
+
+import (
+    "bytes"
+    "sync"
+    "testing"
+)
+
+
+func TestSyncDBConcurrent(t *testing.T) {
+    db := parallelDB(500)
+    sdb := NewSyncDB(db)
+
+    var wait sync.WaitGroup
+    spawned := make(chan Entity, 4000)
+    for worker := 0; worker < 4; worker++ {
+        wait.Add(4)
+
+        // Writers create and delete entities
+        go func() {
+            defer wait.Done()
+            for i := 0; i < 500; i++ { spawned <- sdb.New("health", "tag") }
+        }()
+        go func() {
+            defer wait.Done()
+            for i := 0; i < 250; i++ {
+                eid := <-spawned
+                sdb.Delete(eid)
+                if sdb.Alive(eid) { t.Errorf("entity %d alive after deleting it", eid) }
+            }
+        }()
+
+        // Readers search, iterate and save while the writers work
+        go func() {
+            defer wait.Done()
+            for i := 0; i < 100; i++ {
+                sdb.Search("health", "tag")
+                sdb.Read(func(db *EntityDB) {
+                    for _, eid := range db.Search("health", "tag") {
+                        if !db.Has(eid, "health") { t.Errorf("entity %d found without its health", eid) }
+                    }
+                    last := -1
+                    StoreOf[*testHealth](db).Each(func(eid Entity, health *testHealth) {
+                        if int(eid.Index()) <= last { t.Errorf("health iterated out of order") }
+                        last = int(eid.Index())
+                        _ = health.Max
+                    })
+                    db.Query("health").Without("tag").Count()
+                })
+            }
+        }()
+        go func() {
+            defer wait.Done()
+            for i := 0; i < 10; i++ {
+                var buf bytes.Buffer
+                if err := sdb.Save(&buf); err != nil { t.Error(err) }
+            }
+        }()
+    }
+    wait.Wait()
+    close(spawned)
+
+    left := 0
+    for range spawned { left++ }
+    if n := len(sdb.Search("tag")); n != left { t.Fatalf("%d tagged entities left, want %d", n, left) }
+
+    // The saved world loads back to the same entities
+    var buf bytes.Buffer
+    if err := sdb.Save(&buf); err != nil { t.Fatal(err) }
+    loaded := parallelDB(0)
+    if err := loaded.Load(&buf); err != nil { t.Fatal(err) }
+    if len(loaded.Search("health")) != len(sdb.Search("health")) { t.Fatal("loaded a different world from what was saved") }
+}
+
+func TestSyncDBWrite(t *testing.T) {
+    sdb := NewSyncDB(parallelDB(100))
+
+    var wait sync.WaitGroup
+    for worker := 0; worker < 8; worker++ {
+        wait.Add(1)
+        go func() {
+            defer wait.Done()
+            for i := 0; i < 50; i++ {
+                sdb.Write(func(db *EntityDB) {
+                    query := db.Query("health").Cache()
+                    query.Each(func(eid Entity) { StoreOf[*testHealth](db).Get(eid).Current++ })
+                    query.Release()
+                })
+            }
+        }()
+    }
+    wait.Wait()
+
+    sdb.Read(func(db *EntityDB) {
+        StoreOf[*testHealth](db).Each(func(eid Entity, health *testHealth) {
+            if health.Current != 400 { t.Fatalf("entity %d updated %d times, want 400", eid, health.Current) }
+        })
+    })
+}
@@ -0,0 +1,118 @@
+package engine
+
+
+import (
+    "reflect"
+)
+
+
+/*
+transactions record how to undo every change made to the database since
+they began.  Components are also copied with their clone function the first
+time they're read, since a component handed out by a store can be changed
+through its pointer without the database knowing.  Components are restored
+only as deeply as their clone function copies them, unless they keep a
+Journal instead.
+*/
+type transaction struct {
+    undo []func()
+    stop []func()
+    touched map[touch]bool
+}
+type touch struct {
+    store manager
+    eid Entity
+}
+
+/*
+Journals are components that record their own changes during a transaction
+rather than being cloned the first time they're read, for components too big
+to clone every time or holding state a clone doesn't carry.  Journal is called
+the first time the component is read in a transaction, and returns a function
+undoing every change made to the component since, and one stopping the
+recording that is called once the transaction ends either way.
+*/
+type Journal interface {
+    Journal() (undo func(), stop func())
+}
+
+/*
+Begin starts recording changes so they can be rolled back.  Transactions
+can't be nested, and can't be used while systems run in parallel.
+*/
+func (db *EntityDB) Begin() {
+    if db.tx != nil { panic("EntityDB: A transaction is already in progress") }
+    db.tx = &transaction{touched: make(map[touch]bool)}
+}
+
+/*
+Commit keeps every change made since Begin
+*/
+func (db *EntityDB) Commit() {
+    if db.tx == nil { panic("EntityDB: No transaction in progress") }
+    stop := db.tx.stop
+    db.tx = nil
+    for _, fn := range stop { fn() }
+}
+
+/*
+Rollback undoes every change made since Begin, including components created,
+set or removed, entities created or deleted, relations and entity ids
+*/
+func (db *EntityDB) Rollback() {
+    if db.tx == nil { panic("EntityDB: No transaction in progress") }
+
+    // Undoing changes makes more changes, which mustn't be recorded
+    undo, stop := db.tx.undo, db.tx.stop
+    db.tx = nil
+    for i := len(undo) - 1; i >= 0; i-- { undo[i]() }
+    for _, fn := range stop { fn() }
+}
+
+/*
+InTransaction returns true if changes are being recorded
+*/
+func (db *EntityDB) InTransaction() bool {
+    return db.tx != nil
+}
+
+/*
+record adds a way to undo a change to the current transaction, if there is one
+*/
+func (db *EntityDB) record(undo func()) {
+    if db.tx != nil { db.tx.undo = append(db.tx.undo, undo) }
+}
+
+/*
+touch saves a copy of a component the first time it's read in a transaction,
+so changes made through a pointer to it can be undone.  Components that
+aren't pointers can't be changed that way and aren't copied, and ones with a
+Journal start it instead.
+*/
+func (store *Store[T]) touch(eid Entity, comp T) {
+    if store.db.tx == nil { return }
+
+    current := reflect.ValueOf(comp)
+    if current.Kind() != reflect.Pointer || current.IsNil() { return }
+
+    key := touch{store: store, eid: eid}
+    if store.db.tx.touched[key] { return }
+    store.db.tx.touched[key] = true
+
+    if journal, ok := any(comp).(Journal); ok {
+        undo, stop := journal.Journal()
+        store.db.record(func() {
+            undo()
+            store.MarkChanged(eid)
+        })
+        store.db.tx.stop = append(store.db.tx.stop, stop)
+        return
+    }
+
+    saved := reflect.ValueOf(store.clone(comp))
+    if saved.Type() != current.Type() || saved.IsNil() { return }
+    store.db.record(func() {
+        current.Elem().Set(saved.Elem())
+        store.MarkChanged(eid)
+    })
+}
@@ -0,0 +1,141 @@
+package engine
+
+
+import (
+    "testing"
+)
+
+
+func TestRollbackCreate(t *testing.T) {
+    db := parallelDB(3)
+    db.Begin()
+    eid := db.New("health", "tag")
+    db.Rollback()
+
+    if db.Alive(eid) || StoreOf[*testHealth](db).Has(eid) || len(db.Search("tag")) != 0 { t.Fatal("created entity survived the rollback") }
+    if again := db.New(); again != eid { t.Fatalf("next entity is %v, want the rolled back id %v", again, eid) }
+}
+
+func TestRollbackReusedID(t *testing.T) {
+    db := parallelDB(3)
+    dead := db.Search("health")[1]
+    db.Delete(dead)
+
+    db.Begin()
+    reused := db.New()
+    if reused.Index() != dead.Index() || reused.Generation() != dead.Generation()+1 { t.Fatalf("new entity %v didn't reuse %v", reused, dead) }
+    db.Rollback()
+
+    if db.Alive(reused) || db.Alive(dead) { t.Fatal("rollback brought an entity back to life") }
+    if again := db.New(); again != reused { t.Fatalf("next entity is %v, want %v from the free list", again, reused) }
+}
+
+func TestRollbackSetRemove(t *testing.T) {
+    db := parallelDB(2)
+    eid := db.Search("health")[0]
+    healths, attacks := StoreOf[*testHealth](db), StoreOf[*testAttack](db)
+    health, attack := healths.Get(eid), attacks.Get(eid)
+
+    db.Begin()
+    healths.Set(eid, &testHealth{Current: 7})
+    attacks.Remove(eid)
+    db.Set(eid, "tag", true)
+    db.Rollback()
+
+    if healths.Get(eid) != health || attacks.Get(eid) != attack { t.Fatal("rollback didn't restore the original components") }
+    if db.Has(eid, "tag") { t.Fatal("set component survived the rollback") }
+}
+
+func TestRollbackPointerChanges(t *testing.T) {
+    db := parallelDB(1)
+    eid := db.Search("health")[0]
+    healths := StoreOf[*testHealth](db)
+    health := healths.Get(eid)
+    health.Current = 3
+
+    db.Begin()
+    healths.Get(eid).Current = 10
+    healths.Get(eid).Max = 20
+    db.Rollback()
+
+    if healths.Get(eid) != health || *health != (testHealth{Current: 3}) { t.Fatalf("health rolled back to %+v, want {Current:3}", *health) }
+}
+
+func TestRollbackDeleteCascade(t *testing.T) {
+    db := parallelDB(0)
+    parent := db.New("health")
+    child, grandchild := db.New("attack"), db.New("attack")
+    db.SetParent(child, parent)
+    db.SetParent(grandchild, child)
+    attack := StoreOf[*testAttack](db).Get(grandchild)
+
+    db.Begin()
+    db.Delete(parent, CascadeChildren)
+    if db.Alive(parent) || db.Alive(child) || db.Alive(grandchild) { t.Fatal("cascade didn't delete every descendant") }
+    db.Rollback()
+
+    for _, eid := range []Entity{parent, child, grandchild} {
+        if !db.Alive(eid) { t.Fatalf("entity %v still deleted", eid) }
+    }
+    if db.Parent(child) != parent || db.Parent(grandchild) != child { t.Fatal("rollback didn't restore the relations") }
+    if StoreOf[*testAttack](db).Get(grandchild) != attack || !db.Has(parent, "health") { t.Fatal("rollback didn't restore the components") }
+    if again := db.New(); again.Index() != grandchild.Index()+1 || again.Generation() != 0 { t.Fatalf("next entity is %v, want a fresh id rather than a freed one", again) }
+}
+
+func TestRollbackRelations(t *testing.T) {
+    db := parallelDB(3)
+    eids := db.Search("health")
+    db.Relate("likes", eids[0], eids[1])
+
+    db.Begin()
+    db.Unrelate("likes", eids[0], eids[1])
+    db.Relate("likes", eids[0], eids[2])
+    db.Rollback()
+
+    if related := db.Related("likes", eids[0]); len(related) != 1 || related[0] != eids[1] { t.Fatalf("relations rolled back to %v", related) }
+    if len(db.RelatedTo("likes", eids[2])) != 0 { t.Fatal("relation made in the transaction survived") }
+}
+
+func TestCommit(t *testing.T) {
+    db := parallelDB(1)
+    eid := db.Search("health")[0]
+    db.Begin()
+    made := db.New("tag")
+    StoreOf[*testHealth](db).Get(eid).Current = 5
+    db.Commit()
+
+    if db.InTransaction() || !db.Alive(made) || StoreOf[*testHealth](db).Get(eid).Current != 5 { t.Fatal("commit didn't keep the changes") }
+}
+
+/*
+testJournal is a component that keeps its own journal
+*/
+type testJournal struct {
+    Value int
+    journal []int
+    stopped int
+}
+func (j *testJournal) Journal() (func(), func()) {
+    j.journal = []int{j.Value}
+    undo := func() { j.Value = j.journal[0] }
+    stop := func() { j.journal = nil; j.stopped++ }
+    return undo, stop
+}
+
+func TestJournal(t *testing.T) {
+    db := NewEntityDB()
+    journals := RegisterStore(db, "journal", func() *testJournal { return &testJournal{} }, func(j *testJournal) *testJournal { panic("journals aren't cloned") })
+    eid := db.New()
+    journals.Set(eid, &testJournal{Value: 1})
+
+    db.Begin()
+    journals.Get(eid).Value = 2
+    journals.Get(eid).Value = 3
+    db.Rollback()
+    if j := journals.Get(eid); j.Value != 1 || j.stopped != 1 { t.Fatalf("journal rolled back to %d, stopped %d times", j.Value, j.stopped) }
+
+    db.Begin()
+    journals.Get(eid).Value = 4
+    db.Commit()
+    if j := journals.Get(eid); j.Value != 4 || j.stopped != 2 { t.Fatalf("journal committed %d, stopped %d times", j.Value, j.stopped) }
+}
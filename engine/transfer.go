@@ -0,0 +1,328 @@
+package engine
+
+
+import (
+    "cmp"
+    "maps"
+    "reflect"
+    "slices"
+)
+
+
+/*
+EntityRemappers are components, or values inside components, that hold
+entities where reflection can't reach them, such as in unexported fields.
+RemapEntities must replace every entity held with remap(entity), and must not
+change anything shared with other components when nothing is replaced.
+*/
+type EntityRemapper interface {
+    RemapEntities(remap func(Entity) Entity)
+}
+
+/*
+CopyOptions change what else gets copied along with an entity
+*/
+type CopyOption struct {
+    references bool
+    relation string
+    from, to Entity
+}
+
+/*
+CopyReferences also copies every entity referenced by the copied entity's
+components, along with everything those reference, and so on
+*/
+var CopyReferences = CopyOption{references: true}
+
+/*
+CopyRelated also copies every entity related to the copied entity through the
+named relation, along with everything related to those, and so on
+*/
+func CopyRelated(relation string) CopyOption {
+    return CopyOption{relation: relation}
+}
+
+/*
+CopyChildren also copies an entity's children, their children, and so on
+*/
+var CopyChildren = CopyRelated(ChildOf)
+
+/*
+Remap makes references to from point to to in the copies, rather than
+copying from.  Useful for entities that exist in both databases, like a map.
+*/
+func Remap(from, to Entity) CopyOption {
+    return CopyOption{from: from, to: to}
+}
+
+
+
+/*
+CopyTo copies an entity into another database, returning the copy.  Entities
+referenced by the copy's components that weren't copied or remapped are
+replaced with the zero entity, and relations are kept wherever both ends were
+copied.  Every copied component must be registered in dst under the same name
+and type, and must be cloned deeply enough that changing the copy's
+references doesn't change the original.
+*/
+func (db *EntityDB) CopyTo(dst *EntityDB, eid Entity, options ...CopyOption) (Entity, error) {
+    _, _, remapped, err := db.copyTo(dst, eid, options)
+    if err != nil { return 0, err }
+    return remapped[eid], nil
+}
+
+/*
+MoveTo copies an entity into another database like CopyTo, then deletes it
+from this one along with everything copied through relations.  Entities
+copied only because they were referenced are deleted too, unless an entity
+or resource left in this database still references them, so moving a bat
+leaves behind the map it was on and the player it was chasing.
+*/
+func (db *EntityDB) MoveTo(dst *EntityDB, eid Entity, options ...CopyOption) (Entity, error) {
+    copies, owned, remapped, err := db.copyTo(dst, eid, options)
+    if err != nil { return 0, err }
+
+    for _, src := range db.leaving(copies, owned) { db.Delete(src) }
+    return remapped[eid], nil
+}
+
+/*
+leaving returns the copies a move deletes: every owned copy, and every other
+copy that nothing staying behind references.  Whatever stays keeps the
+copies it references, which then stay too.
+*/
+func (db *EntityDB) leaving(copies []Entity, owned map[Entity]bool) []Entity {
+    leaving := make(map[Entity]bool, len(copies))
+    candidates := 0
+    for _, eid := range copies {
+        leaving[eid] = true
+        if !owned[eid] { candidates++ }
+    }
+
+    var staying []Entity
+    keep := func(other Entity) Entity {
+        if leaving[other] && !owned[other] {
+            delete(leaving, other)
+            staying = append(staying, other)
+            candidates--
+        }
+        return other
+    }
+    for _, res := range db.resources { remapEntities(reflect.ValueOf(res.value), keep, make(map[pointer]bool)) }
+    for _, eid := range db.alive.dense {
+        if !leaving[eid] { staying = append(staying, eid) }
+    }
+    for i := 0; i < len(staying) && candidates > 0; i++ {
+        for _, manager := range db.order {
+            if manager.Has(staying[i]) { remapEntities(reflect.ValueOf(manager.Value(staying[i])), keep, make(map[pointer]bool)) }
+        }
+    }
+
+    deleted := make([]Entity, 0, len(copies))
+    for _, eid := range copies {
+        if leaving[eid] { deleted = append(deleted, eid) }
+    }
+    return deleted
+}
+
+/*
+copyTo copies an entity and everything gathered with it, returning the
+copied entities, which of them were owned by the entity rather than only
+referenced, and the id each was copied to
+*/
+func (db *EntityDB) copyTo(dst *EntityDB, eid Entity, options []CopyOption) ([]Entity, map[Entity]bool, map[Entity]Entity, error) {
+    if !db.Alive(eid) { return nil, nil, nil, &Error{Err: ErrDeadEntity, Entity: eid} }
+
+    remapped := make(map[Entity]Entity)
+    references := false
+    for _, option := range options {
+        if option.from != 0 { remapped[option.from] = option.to }
+        references = references || option.references
+    }
+
+    // Gather everything to copy, following relations and references
+    copies := []Entity{eid}
+    seen := map[Entity]bool{eid: true}
+    owned := map[Entity]bool{eid: true}
+    visit := func(other Entity) Entity {
+        _, ok := remapped[other]
+        if !ok && !seen[other] && db.Alive(other) {
+            seen[other] = true
+            copies = append(copies, other)
+        }
+        return other
+    }
+    for i := 0; i < len(copies); i++ {
+        for _, option := range options {
+            if option.relation == "" { continue }
+            for _, other := range db.relations[option.relation].sourcesOf(copies[i]) {
+                visit(other)
+                if seen[other] { owned[other] = true }
+            }
+        }
+        if !references { continue }
+        for _, manager := range db.order {
+            if manager.Has(copies[i]) { remapEntities(reflect.ValueOf(manager.Value(copies[i])), visit, make(map[pointer]bool)) }
+        }
+    }
+
+    // Check everything can be copied before changing anything
+    for _, src := range copies {
+        for _, manager := range db.order {
+            if !manager.Has(src) { continue }
+            target, err := dst.TryManager(manager.Name())
+            if err != nil { return nil, nil, nil, err }
+            if target.Schema().Type != manager.Schema().Type { return nil, nil, nil, &Error{Err: ErrWrongType, Name: manager.Name()} }
+        }
+    }
+
+    for _, src := range copies { remapped[src] = dst.allocate() }
+    remap := func(other Entity) Entity { return remapped[other] }
+
+    for _, src := range copies {
+        for _, manager := range db.order {
+            if !manager.Has(src) { continue }
+            comp := remapComponent(manager.Copy(manager.Value(src)), remap)
+            dst.managers[manager.Name()].Assign(remapped[src], comp)
+        }
+    }
+    for _, name := range slices.Sorted(maps.Keys(db.relations)) {
+        for _, src := range copies {
+            for _, to := range db.relations[name].targetsOf(src) {
+                if remapped[to] != 0 { dst.Relate(name, remapped[src], remapped[to]) }
+            }
+        }
+    }
+    return copies, owned, remapped, nil
+}
+
+
+
+var entityType = reflect.TypeFor[Entity]()
+var remapperType = reflect.TypeFor[EntityRemapper]()
+
+type pointer struct {
+    kind reflect.Type
+    address uintptr
+}
+
+/*
+remapComponent replaces every entity in a component, returning the component
+*/
+func remapComponent(comp interface{}, remap func(Entity) Entity) interface{} {
+    value := reflect.ValueOf(comp)
+    if !value.IsValid() { return comp }
+
+    // Work on an addressable copy so components that aren't pointers can be changed
+    copied := reflect.New(value.Type()).Elem()
+    copied.Set(value)
+    remapEntities(copied, remap, make(map[pointer]bool))
+    return copied.Interface()
+}
+
+/*
+remapEntities walks a value replacing every entity it can reach, following
+pointers, interfaces, structs, slices, arrays and maps.  Values that can't
+be changed in place are only copied back when an entity in them changed.
+*/
+func remapEntities(value reflect.Value, remap func(Entity) Entity, seen map[pointer]bool) {
+    if value.Kind() == reflect.Pointer && !value.IsNil() && value.CanInterface() && value.Type().Implements(remapperType) {
+        value.Interface().(EntityRemapper).RemapEntities(remap)
+        return
+    }
+
+    switch value.Kind() {
+    case reflect.Uint64:
+        if value.Type() != entityType { return }
+        old := Entity(value.Uint())
+        if eid := remap(old); eid != old && value.CanSet() { value.SetUint(uint64(eid)) }
+
+    case reflect.Pointer:
+        key := pointer{value.Type(), value.Pointer()}
+        if value.IsNil() || seen[key] { return }
+        seen[key] = true
+        remapEntities(value.Elem(), remap, seen)
+
+    case reflect.Interface:
+        if value.IsNil() { return }
+        elem := value.Elem()
+        if elem.Kind() == reflect.Pointer || !value.CanSet() {
+            remapEntities(elem, remap, seen)
+            return
+        }
+        copied := reflect.New(elem.Type()).Elem()
+        copied.Set(elem)
+        if remapCopy(copied, remap, seen) { value.Set(copied) }
+
+    case reflect.Struct:
+        for i := 0; i < value.NumField(); i++ { remapEntities(value.Field(i), remap, seen) }
+
+    case reflect.Slice, reflect.Array:
+        for i := 0; i < value.Len(); i++ { remapEntities(value.Index(i), remap, seen) }
+
+    case reflect.Map:
+        if !value.CanInterface() {
+            // Maps in unexported fields can only be read
+            for _, key := range mapKeys(value) {
+                remapEntities(key, remap, seen)
+                remapEntities(value.MapIndex(key), remap, seen)
+            }
+            return
+        }
+
+        // Remap into a new map, since a remapped key could land on a key that
+        //  hasn't been visited yet
+        remapped := reflect.MakeMapWithSize(value.Type(), value.Len())
+        changed := false
+        for _, key := range mapKeys(value) {
+            newkey := reflect.New(key.Type()).Elem()
+            newkey.Set(key)
+            newval := reflect.New(value.Type().Elem()).Elem()
+            newval.Set(value.MapIndex(key))
+
+            changed = remapCopy(newkey, remap, seen) || changed
+            changed = remapCopy(newval, remap, seen) || changed
+            remapped.SetMapIndex(newkey, newval)
+        }
+        if !changed { return }
+        if value.CanSet() {
+            value.Set(remapped)
+            return
+        }
+
+        // Maps that can't be replaced are refilled instead
+        value.Clear()
+        for iter := remapped.MapRange(); iter.Next(); { value.SetMapIndex(iter.Key(), iter.Value()) }
+    }
+}
+
+/*
+mapKeys returns the keys of a map, sorted when they are numbers or strings so
+that entities are always found in the same order
+*/
+func mapKeys(value reflect.Value) []reflect.Value {
+    keys := value.MapKeys()
+    slices.SortFunc(keys, func(a, b reflect.Value) int {
+        switch {
+        case a.CanInt(): return cmp.Compare(a.Int(), b.Int())
+        case a.CanUint(): return cmp.Compare(a.Uint(), b.Uint())
+        case a.CanFloat(): return cmp.Compare(a.Float(), b.Float())
+        case a.Kind() == reflect.String: return cmp.Compare(a.String(), b.String())
+        }
+        return 0
+    })
+    return keys
+}
+
+/*
+remapCopy remaps a copy of a value, returning true if any entity in it changed
+*/
+func remapCopy(copied reflect.Value, remap func(Entity) Entity, seen map[pointer]bool) bool {
+    changed := false
+    remapEntities(copied, func(eid Entity) Entity {
+        other := remap(eid)
+        if other != eid { changed = true }
+        return other
+    }, seen)
+    return changed
+}
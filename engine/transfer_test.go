@@ -0,0 +1,87 @@
+package engine
+
+
+import (
+    "testing"
+)
+
+
+type testScores struct {
+    By map[Entity]int
+}
+
+func TestCopyRemapsMapKeys(t *testing.T) {
+    clone := func(s *testScores) *testScores {
+        tmp := &testScores{By: make(map[Entity]int)}
+        for k, v := range s.By { tmp.By[k] = v }
+        return tmp
+    }
+
+    for run := 0; run < 50; run++ {
+        src, dst := NewEntityDB(), NewEntityDB()
+        RegisterStore(src, "scores", func() *testScores { return &testScores{} }, clone)
+        RegisterStore(dst, "scores", func() *testScores { return &testScores{} }, clone)
+
+        // Copies are given ids that already appear as keys in the source map
+        a, b, c := src.New(), src.New(), src.New()
+        dst.New()
+        scores := StoreOf[*testScores](src)
+        scores.Set(a, &testScores{By: map[Entity]int{b: 10, c: 20}})
+
+        copied, err := src.CopyTo(dst, a, CopyReferences)
+        if err != nil { t.Fatal(err) }
+
+        got := StoreOf[*testScores](dst).Get(copied).By
+        nb, nc := Entity(3), Entity(4)
+        if len(got) != 2 || got[nb] != 10 || got[nc] != 20 { t.Fatalf("copied map is %v, want map[%d:10 %d:20]", got, nb, nc) }
+        if orig := scores.Get(a).By; len(orig) != 2 || orig[b] != 10 || orig[c] != 20 { t.Fatalf("source map changed to %v", orig) }
+    }
+}
+
+type testFollow struct {
+    Target Entity
+}
+
+/*
+followDBs creates a source and destination database with a bat following a
+player, its own sword and a template only it uses
+*/
+func followDBs() (src, dst *EntityDB, bat, player, sword, template Entity) {
+    src, dst = NewEntityDB(), NewEntityDB()
+    for _, db := range []*EntityDB{src, dst} {
+        RegisterStore(db, "follow", func() *testFollow { return &testFollow{} }, func(f *testFollow) *testFollow { tmp := *f; return &tmp })
+        RegisterResource(db, "player", &testFollow{})
+    }
+
+    player, template = src.New(), src.New()
+    bat, sword = src.New("follow"), src.New("follow")
+    StoreOf[*testFollow](src).Get(bat).Target = player
+    StoreOf[*testFollow](src).Get(sword).Target = template
+    src.SetParent(sword, bat)
+    Resource[*testFollow](src).Target = player
+    return
+}
+
+func TestMoveLeavesReferencedEntities(t *testing.T) {
+    src, dst, bat, player, sword, template := followDBs()
+    other := src.New("follow")
+    StoreOf[*testFollow](src).Get(other).Target = bat
+
+    if _, err := src.MoveTo(dst, bat, CopyReferences, CopyChildren); err != nil { t.Fatal(err) }
+    if src.Alive(bat) || src.Alive(sword) { t.Fatal("moved entity or its children left behind") }
+    if !src.Alive(player) { t.Fatal("move deleted the player a resource still references") }
+    if src.Alive(template) { t.Fatal("move left behind a template only the moved entities used") }
+    if len(dst.Search("follow")) != 2 { t.Fatal("moved entities weren't copied") }
+}
+
+func TestMoveKeepsWhatStayingEntitiesReference(t *testing.T) {
+    src, dst, bat, player, _, template := followDBs()
+    Resource[*testFollow](src).Target = 0
+
+    // The template is referenced through the player, who stays since another follower targets them
+    StoreOf[*testFollow](src).Set(player, &testFollow{Target: template})
+    StoreOf[*testFollow](src).Set(src.New(), &testFollow{Target: player})
+
+    if _, err := src.MoveTo(dst, bat, CopyReferences, CopyChildren); err != nil { t.Fatal(err) }
+    if !src.Alive(player) || !src.Alive(template) { t.Fatal("move deleted entities still referenced in the source") }
+}
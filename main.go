@@ -1,10 +1,11 @@
 package main
 
 import (
+    "bytes"
+    _ "embed"
     "fmt"
     "github.com/nsf/termbox-go"
     "math"
-    "math/rand"
     "os"
     "strconv"
     "time"
@@ -111,22 +112,33 @@ func DrawTextBox(x, y int, fg, bg base.Color, size int) string {
 MAP GENERATION
 */
 type StoneFieldGenerator struct {
-    stone, grass engine.Entity
-    fill float64
+    Stone, Grass engine.Entity
+    Fill float64
+    Rand base.RNG
 }
 func NewStoneFieldGenerator(db *engine.EntityDB, fill float64) *StoneFieldGenerator {
-    grass := db.New(); db.Set(grass, "art", base.NewArt('.', 0, 1, 0, 0, 0, 0))
-    stone := db.New(); db.Set(stone, "art", base.NewArt('#',  .7,  .7 , .7, 0, 0, 0))
-    return &StoneFieldGenerator{stone: stone, grass: grass, fill: fill}
+    grass := db.Spawn("grass")
+    stone := db.Spawn("stone")
+    seed := engine.Resource[*base.RNG](db).Uint64()
+    return &StoneFieldGenerator{Stone: stone, Grass: grass, Fill: fill, Rand: *base.NewRNG(seed)}
+}
+func (g *StoneFieldGenerator) Clone() base.ChunkGenerator {
+    tmp := *g
+    return &tmp
+}
+func (g *StoneFieldGenerator) RemapEntities(remap func(engine.Entity) engine.Entity) {
+    g.Stone, g.Grass = remap(g.Stone), remap(g.Grass)
 }
 func (g *StoneFieldGenerator) GenerateChunk(emap *base.EntityMap, x, y, z int64) {
     chunk := emap.CreateChunk(x, y, z)
-    for x := int64(0); x < 16; x++ {
-        for y := int64(0); y < 16; y++ {
-            if rand.Float64() < g.fill {
-                chunk.Set(x, y, 0, g.stone)
-            } else {
-                chunk.Set(x, y, 0, g.grass)
+    for z := int64(0); z < 4; z++ {
+        for x := int64(0); x < 16; x++ {
+            for y := int64(0); y < 16; y++ {
+                if g.Rand.Float64() < g.Fill {
+                    chunk.Set(x, y, z, g.Stone)
+                } else {
+                    chunk.Set(x, y, z, g.Grass)
+                }
             }
         }
     }
@@ -139,7 +151,7 @@ func CreateMap(db *engine.EntityDB) engine.Entity {
     retval := db.New("map")
 
     // Register a chunk generator on the map
-    emap := db.Get(retval, "map").(*base.EntityMap)
+    emap := engine.StoreOf[*base.EntityMap](db).Get(retval)
     emap.RegisterChunkGenerator(NewStoneFieldGenerator(db, .05))
 
     return retval
@@ -151,26 +163,23 @@ RenderMapAt draws a portion of the map centered at the given entity
 func RenderMapAt(db *engine.EntityDB, eid engine.Entity) {
     width, height := termbox.Size()
 
-    pos := db.Get(eid, "position").(*base.Position)
-    emap := db.Get(pos.R, "map").(*base.EntityMap)
+    arts := engine.StoreOf[*base.Art](db)
+    pos := engine.StoreOf[*base.Position](db).Get(eid)
+    emap := engine.StoreOf[*base.EntityMap](db).Get(pos.R)
 
     for y := 0; y < height; y++ {
         py := pos.Y+int64(y-height/2)
         for x := 0; x < width; x++ {
             px := pos.X+int64(x-width/2)
 
-            // Search for the highest entity on the map in the same general layer
-            //  as the passed entity that can be drawn.  This will need to be more
-            //  formal in the future (not hardcoded knowing the player is on z level
-            //  1, tiles are on z level 0, and the bat at z level 2)
+            // Search down through the layers of the tile on the passed entity's
+            //  level for the highest entity that can be drawn
             topArt := &base.Art{}
-            for i := int64(1); i >= -1; i-- {
-                entity := emap.Get(px, py, pos.Z+i)
-                if db.Has(entity, "art") {
-                    topArt = db.Get(entity, "art").(*base.Art)
-                    break
-                }
-            }
+            emap.Each(px, py, pos.Z, func(entity engine.Entity, layer base.Layer) bool {
+                art, ok := arts.Lookup(entity)
+                if ok { topArt = art }
+                return !ok
+            })
 
             // And draw the found art, which will be an empty black square
             //  if nothing was found
@@ -195,8 +204,15 @@ func (ai *FollowAI) Clone() base.AIController {
     return &FollowAI{Target: ai.Target}
 }
 func (ai *FollowAI) Act(db *engine.EntityDB, eid engine.Entity) {
-    epos := db.Get(eid, "position").(*base.Position)
-    tpos := db.Get(ai.Target, "position").(*base.Position)
+    positions := engine.StoreOf[*base.Position](db)
+
+    // Stay put if the target has been deleted or left the map
+    epos := positions.Get(eid)
+    tpos, ok := positions.Lookup(ai.Target)
+    if !ok || !db.Alive(ai.Target) {
+        base.HelperMove(db, eid, 0, 0, 0)
+        return
+    }
 
     dx, dy := int64(0), int64(0)
     if epos.X > tpos.X+1 || epos.X < tpos.X-1 {
@@ -206,18 +222,33 @@ func (ai *FollowAI) Act(db *engine.EntityDB, eid engine.Entity) {
         dy = int64(math.Copysign(1, float64(tpos.Y-epos.Y)))
     }
 
-    // Since the bat is situated at z-level 2, it will never find
-    // a wall with art symbol '#' at one level below, so this move
-    // function still allows the bat to fly over stones! ^_^
-    // Hence the "+1" for the z; so the bat stays one level above
-    //  the player.
-    base.HelperMove(db, eid, dx, dy, tpos.Z-epos.Z+1)
+    dz := int64(0)
+    if epos.Z != tpos.Z { dz = int64(math.Copysign(1, float64(tpos.Z-epos.Z))) }
+
+    // Bats fly, and stone tiles let flyers through, so bats still
+    //  fly over stones! ^_^
+    base.HelperMove(db, eid, dx, dy, dz)
 }
 
 
-var (
-    done = false
-)
+/*
+Control holds requests from the player to the game itself
+*/
+type Control struct {
+    Quit bool
+    Message string      // Shown over the map until the player's next key press
+}
+
+/*
+Games are saved here when the player quits
+*/
+const saveFile = "rogue.sav"
+
+/*
+Maps page chunks far from the player out to region files while playing,
+named after the map entity
+*/
+const regionFiles = "rogue-%d.region"
 
 /*
 PlayerAI makes an entity respond to player controls.
@@ -232,6 +263,11 @@ func (ai *PlayerAI) Clone() base.AIController {
 func (ai *PlayerAI) Act(db *engine.EntityDB, eid engine.Entity) {
         // RENDERING
         RenderMapAt(db, eid)
+        if control := engine.Resource[*Control](db); control.Message != "" {
+            DrawString(0, 0, control.Message, base.RGB(1, 0, 0), base.RGB(0, 0, 0))
+            termbox.Flush()
+            control.Message = ""
+        }
 
         // INPUT HANDLING
         event := termbox.PollEvent()
@@ -247,12 +283,12 @@ func (ai *PlayerAI) Act(db *engine.EntityDB, eid engine.Entity) {
         case 'u': dx =  1; dy =  1
         case 'b': dx = -1; dy = -1
         case 'n': dx =  1; dy = -1
-        case '>': dz = -4
-        case '<': dz =  4
+        case '>': dz = -1
+        case '<': dz =  1
         case 0:
             switch event.Key {
             case termbox.KeyCtrlQ:
-                done = true
+                engine.Resource[*Control](db).Quit = true
             }
         }
 
@@ -346,7 +382,9 @@ func (ui *UI) Run() {
 /*
 TitleState
 */
-type TitleState struct {}
+type TitleState struct {
+    Error string      // Shown until the next key press, such as why a save couldn't be loaded
+}
 func NewTitleState() *TitleState {
     return &TitleState{}
 }
@@ -355,9 +393,17 @@ func (title *TitleState) Enter(ui *UI) {}
 func (title *TitleState) Exit(ui *UI) {}
 func (title *TitleState) Update(ui *UI, dt float64) {
     width, height := termbox.Size()
+    termbox.Clear(0, 0)
 
     text := "Press any key to play. Press 'y' to face an bat at your own risk!"
     DrawString(width/8, height/4, text, base.RGB(0, 0, 1), base.RGB(0, 0, 0))
+    if _, err := os.Stat(saveFile); err == nil {
+        DrawString(width/8, height/4+1, "Press 'c' to continue your saved game.  A new game replaces it when you quit.", base.RGB(0, 0, 1), base.RGB(0, 0, 0))
+    }
+    if title.Error != "" {
+        DrawString(width/8, height/4+3, title.Error, base.RGB(1, 0, 0), base.RGB(0, 0, 0))
+        title.Error = ""
+    }
     termbox.Flush()
 
     event := termbox.PollEvent()
@@ -369,6 +415,16 @@ func (title *TitleState) Update(ui *UI, dt float64) {
     case 'y':
         ui.Transition("batmenu")
         return
+    case 'c':
+        game, err := LoadGameState(saveFile)
+        if err != nil {
+            // Stay here rather than starting a new game over the save
+            title.Error = "Couldn't load your saved game: " + err.Error()
+            return
+        }
+        ui.RegisterState("game", game)
+        ui.Transition("game")
+        return
     case 0:
         switch event.Key {
         case termbox.KeyCtrlQ:
@@ -412,44 +468,159 @@ func (menu *BatMenuState) Update(ui *UI, dt float64) {
 }
 
 
+/*
+Prefab definitions for everything in the game
+*/
+//go:embed data/prefabs.json
+var prefabData []byte
+
+/*
+NewGameDB creates an entity database with every component, resource and prefab registered
+*/
+func NewGameDB() *engine.EntityDB {
+    db := engine.NewEntityDB()
+    base.RegisterTypes(db)
+    base.RegisterResources(db)
+    engine.RegisterResource(db, "control", &Control{})
+    if err := db.LoadPrefabs(bytes.NewReader(prefabData)); err != nil { panic(err.Error()) }
+    return db
+}
+
 /*
 GameState
 */
 type GameState struct {
     DB *engine.EntityDB
+    Systems *engine.Scheduler
+    Regions []*base.RegionFile
 }
 func NewGameState(numbats int64) *GameState {
     // Game Data Initialization
-    db := engine.NewEntityDB()
-    base.RegisterTypes(db)
+    db := NewGameDB()
+    engine.SetResource(db, base.NewRNG(uint64(time.Now().UTC().UnixNano())))
 
     tilemap := CreateMap(db)
 
-    player := db.New("movement")
-    db.Set(player, "ai", base.NewAI(NewPlayerAI()))
-    db.Set(player, "art", base.NewArt('@', 1, 0, 0, 0, 0, 0))
-    base.HelperPlace(db, player, tilemap, 0, 0, 1)
-
-    bat := db.New("movement")
-    db.Set(bat, "ai", base.NewAI(NewFollowAI(player)))
-    db.Set(bat, "art", base.NewArt('b', 0, 0, 1, 0, 0, 0))
+    player := db.Spawn("player")
+    base.HelperPlace(db, player, tilemap, 0, 0, 0, base.LayerActors)
+    engine.Resource[*base.Players](db).Add(player)
 
-    // Create bats from the template entity
+    // Create bats from the prefab, all chasing the player
+    ais := engine.StoreOf[*base.AI](db)
+    rng := engine.Resource[*base.RNG](db)
     for i := int64(0); i < numbats; i++ {
-        newBat := db.Instance(bat)
-        base.HelperPlace(db, newBat, tilemap, rand.Int63n(numbats)-numbats/2, rand.Int63n(numbats)-numbats/2, 2)
+        bat := db.Spawn("bat")
+        ais.Get(bat).Controller.(*FollowAI).Target = player
+        base.HelperPlace(db, bat, tilemap, rng.Int63n(numbats)-numbats/2, rng.Int63n(numbats)-numbats/2, 0, base.LayerFlying)
     }
 
-    return &GameState{DB: db}
+    game := &GameState{DB: db, Systems: NewGameSystems()}
+    if err := game.PageMaps(); err != nil {
+        game.Close()
+        panic(err.Error())
+    }
+    return game
+}
+
+/*
+NewGameSystems creates the scheduler for the systems run every turn
+*/
+func NewGameSystems() *engine.Scheduler {
+    sched := engine.NewScheduler()
+    base.RegisterSystems(sched)
+
+    // The player's AI draws the map and can ask to quit
+    sched.Uses("act", []string{"art"}, []string{"control"})
+    return sched
+}
+
+/*
+LoadGameState resumes a game previously saved to the given file
+*/
+func LoadGameState(path string) (*GameState, error) {
+    file, err := os.Open(path)
+    if err != nil { return nil, err }
+    defer file.Close()
+
+    db := NewGameDB()
+    if err := db.Load(file); err != nil { return nil, err }
+
+    game := &GameState{DB: db, Systems: NewGameSystems()}
+    if err := game.PageMaps(); err != nil {
+        game.Close()
+        return nil, err
+    }
+    return game, nil
+}
+
+/*
+PageMaps lets every map page chunks out to its own region file.  Region files
+opened before an error are left in game.Regions for Close to remove.
+*/
+func (game *GameState) PageMaps() error {
+    resident := engine.Resource[*base.Config](game.DB).ResidentChunks
+    var err error
+    engine.StoreOf[*base.EntityMap](game.DB).Each(func(eid engine.Entity, emap *base.EntityMap) {
+        if err != nil { return }
+
+        var region *base.RegionFile
+        region, err = base.OpenRegionFile(fmt.Sprintf(regionFiles, eid.Index()))
+        if err != nil { return }
+        game.Regions = append(game.Regions, region)
+        err = emap.Page(region, resident)
+    })
+    return err
+}
+
+/*
+Close closes the region files once the game is over.  They are only needed
+while playing, so they are removed too.
+*/
+func (game *GameState) Close() {
+    for _, region := range game.Regions {
+        region.Close()
+        os.Remove(region.Name())
+    }
+    game.Regions = nil
+}
+
+/*
+Save writes the game world out to the given file
+*/
+func (game *GameState) Save(path string) error {
+    // Write somewhere else first, so a failed save leaves the old one intact
+    temp := path + ".tmp"
+    file, err := os.Create(temp)
+    if err != nil { return err }
+
+    if err := game.DB.Save(file); err != nil {
+        file.Close()
+        os.Remove(temp)
+        return err
+    }
+    if err := file.Close(); err != nil {
+        os.Remove(temp)
+        return err
+    }
+    return os.Rename(temp, path)
 }
 
 func (game *GameState) Enter(ui *UI) {}
 func (game *GameState) Exit(ui *UI) {}
 func (game *GameState) Update(ui *UI, dt float64) {
-    base.SystemAct(game.DB)
-    base.SystemMove(game.DB)
+    engine.Resource[*base.Clock](game.DB).Time += dt
+    game.Systems.Run(game.DB)
+
+    if control := engine.Resource[*Control](game.DB); control.Quit {
+        control.Quit = false
 
-    if done {
+        // Keep playing if the game can't be saved, since paged out chunks
+        //  only live in the region files until it is
+        if err := game.Save(saveFile); err != nil {
+            control.Message = "Couldn't save your game: " + err.Error()
+            return
+        }
+        game.Close()
         ui.Pop()
     }
 }
@@ -457,8 +628,10 @@ func (game *GameState) Update(ui *UI, dt float64) {
 
 
 func main() {
-    // Seed the random number generator!
-    rand.Seed(time.Now().UTC().UnixNano())
+    // Let AIs and map generators be saved
+    base.RegisterController("player", func() base.AIController { return &PlayerAI{} })
+    base.RegisterController("follow", func() base.AIController { return &FollowAI{} })
+    base.RegisterGenerator("stonefield", func() base.ChunkGenerator { return &StoneFieldGenerator{} })
 
     // GUI and input initialization
     err := termbox.Init()